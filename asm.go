@@ -0,0 +1,637 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Assembly is a line based text form of a stream. Directives start with a dot:
+//
+//	.header <version> <number format> <features>
+//	.frame <sequence> <timestamp> [key]
+//
+// every other line is an update operation by name followed by its operands.
+// Macro bodies are indented and macro constants name their operand type, for
+// example "uopMacroUseConst vec2 10 20". Raw bytes are written as 0x<hex>.
+// Text after ';' is a comment. A compressed frame marked key is a key frame
+// the server was asked for. Disassemble and Assemble round trip to the same
+// bytes.
+
+// ---------------------------- DISASSEMBLER ----------------------------------
+
+type disassembler struct {
+	text           strings.Builder
+	header         StreamHeader
+	macroVariables map[MacroNumber][]OperandType // variable types of every defined macro
+	nodeContents   map[NodeNumber]MacroNumber
+	library        *MacroLibrary // for the variables of loaded library macros
+	wipNumber      MacroNumber
+	wipVariables   []OperandType
+	inMacro        bool
+	pending        []OperandType // operands of the last macro operation still to be given
+	dictionary     compressionDictionary
+}
+
+func newDisassembler(header StreamHeader, library *MacroLibrary) *disassembler {
+	return &disassembler{
+		header:         header,
+		library:        library,
+		macroVariables: map[MacroNumber][]OperandType{},
+		nodeContents:   map[NodeNumber]MacroNumber{},
+	}
+}
+
+// Disassemble turns a stream, the negotiated header followed by frames, into
+// assembly text.
+func Disassemble(stream []byte) (text string, err error) {
+	return DisassembleWithLibrary(stream, nil)
+}
+
+// DisassembleWithLibrary disassembles a stream that loads macros of a library.
+func DisassembleWithLibrary(stream []byte, library *MacroLibrary) (text string, err error) {
+	b := NewBytecodeFromBytes(stream)
+	header, err := b.popStreamHeader()
+	if err != nil {
+		return "", err
+	}
+	if err := header.validate(); err != nil {
+		return "", err
+	}
+	d := newDisassembler(header, library)
+	fmt.Fprintf(&d.text, ".header %d %s %#x\n", header.version, header.numberFormat, header.features)
+	frames := FrameDecoder{varint: header.HasFeature(featureVarint), checksum: header.HasFeature(featureChecksum)}
+	frames.Write(stream[b.i:])
+	for {
+		frame, ok, err := frames.Next()
+		if err != nil {
+			return d.text.String(), err
+		}
+		if !ok {
+			break
+		}
+		fmt.Fprintf(&d.text, ".frame %d %d", frame.sequence, frame.timestamp)
+		if header.HasFeature(featureCompression) && len(frame.payload) > 0 &&
+			frame.payload[0]&frameDeltaDictionary == 0 && d.dictionary.deltaPossible(frame.sequence) {
+			d.text.WriteString(" key")
+		}
+		d.text.WriteString("\n")
+		operations := frame.payload
+		if header.HasFeature(featureCompression) {
+			if operations, err = d.dictionary.decompressBytes(frame.sequence, frame.payload); err != nil {
+				return d.text.String(), err
+			}
+		}
+		if err := d.disassemble(operations); err != nil {
+			return d.text.String(), err
+		}
+		d.dictionary.commit(frame.sequence, operations)
+	}
+	if len(frames.buffered) > 0 {
+		return d.text.String(), fmt.Errorf("stream ends in a partial frame of %d bytes", len(frames.buffered))
+	}
+	return d.text.String(), nil
+}
+
+// DisassembleBytecode turns a single batch of update operations into assembly
+// text.
+func DisassembleBytecode(header StreamHeader, bytes []byte) (string, error) {
+	d := newDisassembler(header, nil)
+	err := d.disassemble(bytes)
+	return d.text.String(), err
+}
+
+func (d *disassembler) disassemble(bytes []byte) (err error) {
+	defer recoverDecodeError(&err)
+	b := NewBytecodeFromBytes(bytes).applyHeader(d.header)
+	for b.i < len(b.bytes) {
+		d.updateOperation(b)
+	}
+	return nil
+}
+
+func (d *disassembler) updateOperation(b *Bytecode) {
+	start := b.i
+	opcode := b.popOpcode()
+	if opcode >= uopCodeCount {
+		b.error(errorUnknownOpcode, "invalid update opcode: "+fmt.Sprint(opcode))
+	}
+	fields := []string{opcodeName(false, opcode)}
+	var macroNumber MacroNumber
+	var nodeNumber NodeNumber
+	var renderOpcode uint8
+	var variableType OperandType
+	comment := ""
+	for _, operandType := range updateOpcodes[opcode].operands {
+		switch operandType {
+		case operandConst:
+			fields = append(fields, d.macroConst(b)...)
+		case operandMacroArgs:
+			variables, ok := d.macroVariables[macroNumber]
+			if !ok {
+				b.error(errorUnknownMacro, "unknown macroNumber: "+fmt.Sprint(macroNumber))
+			}
+			fields = append(fields, d.macroArgs(b, variables)...)
+		case operandMacro:
+			macroNumber = b.popMacroNumber()
+			fields = append(fields, fmt.Sprint(macroNumber))
+		case operandNode:
+			nodeNumber = b.popNodeNumber()
+			fields = append(fields, fmt.Sprint(nodeNumber))
+		case operandVariable:
+			variableNumber := b.popVariableNumber()
+			fields = append(fields, fmt.Sprint(variableNumber))
+			if opcode == uopNodeSetArgument {
+				// the value that follows is for a variable of the node's macro
+				d.pending = nil
+				if variables := d.macroVariables[d.nodeContents[nodeNumber]]; int(variableNumber) < len(variables) {
+					d.pending = variables[variableNumber : variableNumber+1]
+				}
+			}
+		case operandHash:
+			hash := b.popMacroHash()
+			fields = append(fields, "0x"+hex.EncodeToString(hash[:]))
+			if d.library == nil || d.library.macros[hash] == nil {
+				b.error(errorUnknownMacro, fmt.Sprintf("library macro %x unknown to the disassembler", hash))
+			}
+			d.macroVariables[macroNumber] = d.library.macros[hash].macro.variableTypes
+		case operandVariableType:
+			variableType = OperandType(b.popUint8())
+			if !variableType.isVariableType() {
+				b.error(errorOutOfRange, "invalid variable type: "+fmt.Sprint(uint8(variableType)))
+			}
+			fields = append(fields, variableType.String())
+		case operandRenderOpcode:
+			renderOpcode = b.popUint8()
+			fields = append(fields, opcodeName(true, renderOpcode))
+		case operandExtendedCode:
+			code := b.popExtendedCode()
+			fields = append(fields, fmt.Sprint(code))
+			if operation, ok := extendedUpdateRegistry[code]; ok {
+				comment = " ; " + operation.name
+			}
+		default:
+			fields = append(fields, formatOperand(b, operandType)...)
+		}
+	}
+
+	// follow macro definitions to know variable block sizes and which operand
+	// the next macro constant is for
+	switch opcode {
+	case uopMacroStart:
+		d.dictionary.startDefinition(start)
+		d.wipNumber = macroNumber
+		d.wipVariables = []OperandType{}
+		d.pending = nil
+	case uopMacroEnd:
+		d.dictionary.endDefinition(b.i)
+		d.macroVariables[d.wipNumber] = d.wipVariables
+		d.inMacro = false
+	case uopMacroOperation:
+		d.pending = nil
+		if renderOpcode < ropCodeCount {
+			d.pending = renderOpcodes[renderOpcode].operands
+		}
+	case uopMacroVar:
+		d.wipVariables = append(d.wipVariables, variableType)
+	case uopMacroUseVar:
+		d.nextPending()
+	case uopMacroDelete:
+		delete(d.macroVariables, macroNumber)
+	case uopNodeSetContent:
+		d.nodeContents[nodeNumber] = macroNumber
+	}
+
+	if d.inMacro {
+		d.text.WriteString("    ")
+	}
+	d.text.WriteString(strings.Join(fields, " ") + comment + "\n")
+	if opcode == uopMacroStart {
+		d.inMacro = true
+	}
+}
+
+func (d *disassembler) nextPending() OperandType {
+	if len(d.pending) == 0 {
+		return operandConst
+	}
+	operandType := d.pending[0]
+	d.pending = d.pending[1:]
+	return operandType
+}
+
+func (d *disassembler) macroConst(b *Bytecode) []string {
+	size := b.popSize()
+	constBytes := b.popBytes(size)
+	operandType := d.nextPending()
+	if operandType.fixedSize(d.header.numberFormat) != size {
+		return []string{"0x" + hex.EncodeToString(constBytes)}
+	}
+	constBytecode := NewBytecodeFromBytes(constBytes)
+	constBytecode.numberFormat = d.header.numberFormat
+	fields := append([]string{operandType.String()}, formatOperand(constBytecode, operandType)...)
+	if operandType == operandMacro {
+		// the arguments of a macro call follow one constant or variable each
+		d.pending = d.macroVariables[NewBytecodeFromBytes(constBytes).popMacroNumber()]
+	}
+	return fields
+}
+
+// macroArgs formats the arguments of a macro by the types of its variables.
+func (d *disassembler) macroArgs(b *Bytecode, variables []OperandType) []string {
+	args := NewBytecodeFromBytes(b.popBytes(variablesSize(variables, d.header.numberFormat)))
+	args.numberFormat = d.header.numberFormat
+	fields := []string{}
+	for _, variableType := range variables {
+		fields = append(fields, variableType.String())
+		fields = append(fields, formatOperand(args, variableType)...)
+	}
+	return fields
+}
+
+func formatOperand(b *Bytecode, operandType OperandType) []string {
+	switch operandType {
+	case operandUint8:
+		return []string{fmt.Sprint(b.popUint8())}
+	case operandUint16:
+		return []string{fmt.Sprint(b.popUint16())}
+	case operandSize:
+		return []string{fmt.Sprint(b.popSize())}
+	case operandNode:
+		return []string{fmt.Sprint(b.popNodeNumber())}
+	case operandMacro:
+		return []string{fmt.Sprint(b.popMacroNumber())}
+	case operandAnchor:
+		return []string{fmt.Sprint(b.popAnchorNumber())}
+	case operandVariable:
+		return []string{fmt.Sprint(b.popVariableNumber())}
+	case operandNumber:
+		return []string{formatFloat(b.popFloat64())}
+	case operandVec2:
+		v := b.popVec2()
+		return []string{formatFloat(v.X), formatFloat(v.Y)}
+	case operandRgba:
+		return []string{"#" + hex.EncodeToString(b.popBytes(4))}
+	case operandRotation:
+		return []string{formatFloat(b.popRotation())}
+	case operandScale:
+		// scales are written in percent, the unit they are encoded in
+		v := b.popVec2()
+		return []string{formatFloat(v.X) + "%", formatFloat(v.Y) + "%"}
+	case operandAffine:
+		m := b.popAffine()
+		fields := []string{}
+		for _, value := range [6]float64{m.m00, m.m01, m.m02, m.m10, m.m11, m.m12} {
+			fields = append(fields, formatFloat(value))
+		}
+		return fields
+	case operandDelta8:
+		v := b.popDelta8()
+		return []string{formatFloat(v.X), formatFloat(v.Y)}
+	case operandDelta16:
+		v := b.popDelta16()
+		return []string{formatFloat(v.X), formatFloat(v.Y)}
+	case operandRenderOpcode:
+		return []string{opcodeName(true, b.popUint8())}
+	case operandExtendedCode:
+		return []string{fmt.Sprint(b.popExtendedCode())}
+	case operandBlock:
+		return []string{"0x" + hex.EncodeToString(b.popBytes(b.popBlockLength()))}
+	case operandVariableType:
+		return []string{OperandType(b.popUint8()).String()}
+	case operandHash:
+		hash := b.popMacroHash()
+		return []string{"0x" + hex.EncodeToString(hash[:])}
+	}
+	b.error(errorInvalidState, "formatOperand: unsupported operand type "+operandType.String())
+	return nil
+}
+
+// ----------------------------- ASSEMBLER ------------------------------------
+
+type assembler struct {
+	stream     *Bytecode
+	payload    *Bytecode
+	header     StreamHeader
+	frame      Frame
+	framed     bool // a .header was given, operations go into frames
+	inFrame    bool
+	dictionary compressionDictionary
+}
+
+// Assemble turns assembly text back into bytes. Text with a .header directive
+// gives a stream, text without one a single batch of update operations in the
+// default encoding.
+func Assemble(text string) ([]byte, error) {
+	a := assembler{stream: NewBytecode(), payload: NewBytecode()}
+	for lineNumber, line := range strings.Split(text, "\n") {
+		if comment := strings.IndexByte(line, ';'); comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := a.line(fields); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber+1, err)
+		}
+	}
+	if !a.framed {
+		return a.payload.bytes, nil
+	}
+	if a.inFrame {
+		a.flushFrame()
+	}
+	return a.stream.bytes, nil
+}
+
+func (a *assembler) line(fields []string) (err error) {
+	defer recoverEncodeError(&err)
+	switch fields[0] {
+	case ".header":
+		return a.headerDirective(fields[1:])
+	case ".frame":
+		return a.frameDirective(fields[1:])
+	}
+	opcode, ok := lookupOpcode(updateOpcodes[:], fields[0])
+	if !ok {
+		return fmt.Errorf("unknown update operation %q", fields[0])
+	}
+	if a.framed && !a.inFrame {
+		return fmt.Errorf("operation outside of a .frame")
+	}
+	if opcode == uopMacroStart {
+		a.dictionary.startDefinition(len(a.payload.bytes))
+	}
+	a.payload.pushOpcode(opcode)
+	operands := fields[1:]
+	for _, operandType := range updateOpcodes[opcode].operands {
+		var err error
+		switch operandType {
+		case operandConst:
+			operands, err = a.macroConst(operands)
+		case operandMacroArgs:
+			operands, err = a.macroArgs(operands)
+		case operandBlock:
+			operands, err = parseBlock(a.payload, operands)
+		default:
+			operands, err = parseOperand(a.payload, operandType, operands)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(operands) > 0 {
+		return fmt.Errorf("unexpected operands %v", operands)
+	}
+	if opcode == uopMacroEnd {
+		a.dictionary.endDefinition(len(a.payload.bytes))
+	}
+	return nil
+}
+
+func (a *assembler) headerDirective(fields []string) error {
+	if a.framed {
+		return fmt.Errorf("second .header")
+	}
+	if len(fields) != 3 {
+		return fmt.Errorf(".header needs version, number format and features")
+	}
+	version, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return err
+	}
+	features, err := strconv.ParseUint(fields[2], 0, 32)
+	if err != nil {
+		return err
+	}
+	header := StreamHeader{version: uint16(version), features: uint32(features), numberFormat: numberFormatCount}
+	for format := NumberFormat(0); format < numberFormatCount; format++ {
+		if format.String() == fields[1] {
+			header.numberFormat = format
+		}
+	}
+	if err := header.validate(); err != nil {
+		return err
+	}
+	a.header = header
+	a.framed = true
+	a.stream.pushStreamHeader(header)
+	a.payload = NewBytecode().applyHeader(header)
+	return nil
+}
+
+func (a *assembler) frameDirective(fields []string) error {
+	if !a.framed {
+		return fmt.Errorf(".frame before .header")
+	}
+	if a.inFrame {
+		a.flushFrame()
+	}
+	if len(fields) != 2 && (len(fields) != 3 || fields[2] != "key") {
+		return fmt.Errorf(".frame needs sequence and timestamp, and optionally key")
+	}
+	sequence, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return err
+	}
+	timestamp, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return err
+	}
+	a.frame = Frame{sequence: uint32(sequence), timestamp: uint32(timestamp)}
+	a.dictionary.keyRequested = len(fields) == 3
+	a.inFrame = true
+	return nil
+}
+
+func (a *assembler) flushFrame() {
+	a.frame.payload = a.payload.bytes
+	if a.header.HasFeature(featureCompression) {
+		a.frame.payload = a.dictionary.compress(a.frame.sequence, a.payload.bytes)
+		a.dictionary.commit(a.frame.sequence, a.payload.bytes)
+	}
+	framed := NewBytecode().applyHeader(a.header)
+	framed.pushFrame(a.frame)
+	if a.header.HasFeature(featureChecksum) {
+		framed.pushFrameChecksum(0)
+	}
+	a.stream.pushBytes(framed.bytes)
+	a.payload = NewBytecode().applyHeader(a.header)
+}
+
+func (a *assembler) macroConst(fields []string) ([]string, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing constant")
+	}
+	constBytecode := NewBytecode()
+	constBytecode.numberFormat = a.header.numberFormat
+	var rest []string
+	var err error
+	if strings.HasPrefix(fields[0], "0x") {
+		rest, err = parseBytes(constBytecode, fields)
+	} else {
+		operandType, ok := lookupOperandType(fields[0])
+		if !ok || operandType.fixedSize(a.header.numberFormat) == 0 {
+			return nil, fmt.Errorf("unknown constant type %q", fields[0])
+		}
+		rest, err = parseOperand(constBytecode, operandType, fields[1:])
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.payload.pushSize(len(constBytecode.bytes))
+	a.payload.pushBytes(constBytecode.bytes)
+	return rest, nil
+}
+
+// macroArgs parses typed macro arguments, which take the rest of the line, or
+// raw bytes.
+func (a *assembler) macroArgs(fields []string) ([]string, error) {
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "0x") {
+		return parseBytes(a.payload, fields)
+	}
+	args := NewBytecode()
+	args.numberFormat = a.header.numberFormat
+	for len(fields) > 0 {
+		variableType, ok := lookupOperandType(fields[0])
+		if !ok || !variableType.isVariableType() {
+			return nil, fmt.Errorf("unknown argument type %q", fields[0])
+		}
+		var err error
+		if fields, err = parseOperand(args, variableType, fields[1:]); err != nil {
+			return nil, err
+		}
+	}
+	a.payload.pushBytes(args.bytes)
+	return fields, nil
+}
+
+func lookupOperandType(name string) (OperandType, bool) {
+	for operandType := OperandType(0); operandType < operandTypeCount; operandType++ {
+		if operandType.String() == name {
+			return operandType, true
+		}
+	}
+	return 0, false
+}
+
+func parseBytes(b *Bytecode, fields []string) ([]string, error) {
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "0x") {
+		return nil, fmt.Errorf("expected 0x<hex> bytes")
+	}
+	bytes, err := hex.DecodeString(fields[0][2:])
+	if err != nil {
+		return nil, err
+	}
+	b.pushBytes(bytes)
+	return fields[1:], nil
+}
+
+func parseBlock(b *Bytecode, fields []string) ([]string, error) {
+	block := NewBytecode()
+	rest, err := parseBytes(block, fields)
+	if err != nil {
+		return nil, err
+	}
+	b.pushBlockLength(len(block.bytes))
+	b.pushBytes(block.bytes)
+	return rest, nil
+}
+
+func parseOperand(b *Bytecode, operandType OperandType, fields []string) ([]string, error) {
+	count := operandType.tokens()
+	if len(fields) < count {
+		return nil, fmt.Errorf("missing %s operand", operandType)
+	}
+	numbers := make([]float64, count)
+	integer := uint64(0)
+	var err error
+	switch operandType {
+	case operandRgba:
+		if !strings.HasPrefix(fields[0], "#") || len(fields[0]) != 9 {
+			return nil, fmt.Errorf("expected #rrggbbaa color, got %q", fields[0])
+		}
+		color, err := hex.DecodeString(fields[0][1:])
+		if err != nil {
+			return nil, err
+		}
+		b.pushBytes(color)
+		return fields[1:], nil
+	case operandRenderOpcode:
+		opcode, ok := lookupOpcode(renderOpcodes[:], fields[0])
+		if !ok {
+			return nil, fmt.Errorf("unknown render operation %q", fields[0])
+		}
+		b.pushUint8(opcode)
+		return fields[1:], nil
+	case operandVariableType:
+		variableType, ok := lookupOperandType(fields[0])
+		if !ok || !variableType.isVariableType() {
+			return nil, fmt.Errorf("unknown variable type %q", fields[0])
+		}
+		b.pushUint8(uint8(variableType))
+		return fields[1:], nil
+	case operandHash:
+		hash, err := hex.DecodeString(strings.TrimPrefix(fields[0], "0x"))
+		if err != nil || len(hash) != macroHashSize {
+			return nil, fmt.Errorf("expected a %d byte hex macro hash, got %q", macroHashSize, fields[0])
+		}
+		b.pushBytes(hash)
+		return fields[1:], nil
+	case operandUint8, operandSize:
+		integer, err = strconv.ParseUint(fields[0], 10, 8)
+	case operandUint16, operandNode, operandMacro, operandAnchor, operandVariable, operandExtendedCode:
+		integer, err = strconv.ParseUint(fields[0], 10, 16)
+	default:
+		for i := range numbers {
+			numbers[i], err = strconv.ParseFloat(strings.TrimSuffix(fields[i], "%"), 64)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch operandType {
+	case operandUint8:
+		b.pushUint8(uint8(integer))
+	case operandSize:
+		b.pushSize(int(integer))
+	case operandUint16:
+		b.pushUint16(uint16(integer))
+	case operandNode:
+		b.pushNodeNumber(NodeNumber(integer))
+	case operandMacro:
+		b.pushMacroNumber(MacroNumber(integer))
+	case operandAnchor:
+		b.pushAnchorNumber(AnchorNumber(integer))
+	case operandVariable:
+		b.pushVariableNumber(uint16(integer))
+	case operandExtendedCode:
+		b.pushExtendedCode(ExtendedCode(integer))
+	case operandNumber:
+		b.pushFloat64(numbers[0])
+	case operandVec2, operandScale:
+		b.pushVec2(Vec2{numbers[0], numbers[1]})
+	case operandRotation:
+		b.pushRotation(numbers[0])
+	case operandAffine:
+		b.pushAffine(BuildAffineMatrix(numbers[0], numbers[1], numbers[3], numbers[4], numbers[2], numbers[5]))
+	case operandDelta8:
+		if !fitsDelta(Vec2{numbers[0], numbers[1]}, 8) {
+			return nil, fmt.Errorf("delta8 can't represent %v %v", numbers[0], numbers[1])
+		}
+		b.pushDelta8(Vec2{numbers[0], numbers[1]})
+	case operandDelta16:
+		if !fitsDelta(Vec2{numbers[0], numbers[1]}, 16) {
+			return nil, fmt.Errorf("delta16 can't represent %v %v", numbers[0], numbers[1])
+		}
+		b.pushDelta16(Vec2{numbers[0], numbers[1]})
+	default:
+		return nil, fmt.Errorf("unsupported operand type %s", operandType)
+	}
+	return fields[count:], nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// recordTestStream returns the stream of the test scene with the given
+// encoding: the negotiated header, the init frame and update frames.
+func recordTestStream(t *testing.T, numberFormat NumberFormat, features uint32, library *MacroLibrary, frames int) []byte {
+	t.Helper()
+	server := NewServer()
+	server.numberFormat = numberFormat
+	server.features = features
+	client := NewClient(nil)
+	if library != nil {
+		server.UseLibrary(library)
+		client.UseLibrary(library)
+	}
+	answer, err := client.Handshake(server.Offer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Accept(answer); err != nil {
+		t.Fatal(err)
+	}
+	stream := bytes.NewBuffer(EncodeStreamHeader(server.header))
+	if err := server.WriteInit(stream); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < frames; i++ {
+		if err := server.WriteUpdate(stream); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return stream.Bytes()
+}
+
+var testFeatureSets = []uint32{0, featureVarint, featureCompression, featureChecksum, supportedFeatures}
+
+func TestAssembleDisassembledStream(t *testing.T) {
+	for format := NumberFormat(0); format < numberFormatCount; format++ {
+		for _, features := range testFeatureSets {
+			stream := recordTestStream(t, format, features, nil, 40)
+			text, err := Disassemble(stream)
+			if err != nil {
+				t.Fatalf("%s, features %#x: %v", format, features, err)
+			}
+			assembled, err := Assemble(text)
+			if err != nil {
+				t.Fatalf("%s, features %#x: %v", format, features, err)
+			}
+			if !bytes.Equal(assembled, stream) {
+				t.Fatalf("%s, features %#x: assembled stream differs from the recorded one", format, features)
+			}
+		}
+	}
+}
+
+func TestAssembleDisassembledLibraryStream(t *testing.T) {
+	library := newTestLibrary(t)
+	stream := recordTestStream(t, library.numberFormat, supportedFeatures, library, 5)
+	if _, err := Disassemble(stream); err == nil {
+		t.Fatal("stream loading library macros disassembled without the library")
+	}
+	text, err := DisassembleWithLibrary(stream, library)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assembled, err := Assemble(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(assembled, stream) {
+		t.Fatal("assembled stream differs from the recorded one")
+	}
+}
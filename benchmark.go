@@ -0,0 +1,70 @@
+package main
+
+import "fmt"
+
+var benchmarkEncodings = []struct {
+	name         string
+	numberFormat NumberFormat
+	features     uint32
+}{
+	{"fixed16", numberFormatFixed16, 0},
+	{"float32", numberFormatFloat32, 0},
+	{"float64", numberFormatFloat64, 0},
+	{"fixed16 varint", numberFormatFixed16, featureVarint},
+	{"fixed4 varint", numberFormatFixed4, featureVarint},
+	{"fixed16 deflate", numberFormatFixed16, featureCompression},
+	{"fixed4 varint deflate", numberFormatFixed4, featureVarint | featureCompression},
+	{"fixed4 all features", numberFormatFixed4, supportedFeatures},
+}
+
+// runBenchmark streams the test scene from a server to a headless client once
+// per encoding and prints the average size of an update frame and its ratio to
+// the first, uncompressed fixed16 encoding.
+func runBenchmark(frames int) {
+	debug = false
+	baseline := 0.0
+	for _, encoding := range benchmarkEncodings {
+		size, err := benchmarkEncoding(encoding.numberFormat, encoding.features, frames)
+		if err != nil {
+			fmt.Println(encoding.name, ": ", err)
+			continue
+		}
+		if baseline == 0 {
+			baseline = size
+		}
+		fmt.Printf("%-22s %6.1f bytes per update %5.2f\n", encoding.name, size, size/baseline)
+	}
+}
+
+func benchmarkEncoding(numberFormat NumberFormat, features uint32, frames int) (float64, error) {
+	server := NewServer()
+	server.numberFormat = numberFormat
+	server.features = features
+	client := NewClient(nil)
+	answer, err := client.Handshake(server.Offer())
+	if err != nil {
+		return 0, err
+	}
+	if err := server.Accept(answer); err != nil {
+		return 0, err
+	}
+	bytes, err := server.Init()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := client.Update(bytes); err != nil {
+		return 0, err
+	}
+	total := 0
+	for i := 0; i < frames; i++ {
+		bytes, err := server.Update()
+		if err != nil {
+			return 0, err
+		}
+		total += len(bytes)
+		if _, err := client.Update(bytes); err != nil {
+			return 0, err
+		}
+	}
+	return float64(total) / float64(frames), nil
+}
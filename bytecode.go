@@ -1,15 +1,17 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"encoding/binary"
+	"io"
 	"math"
 
 	"github.com/shibukawa/nanovgo"
 )
 
 const uintScaleFactor = 100
-const fixpointMultiplier = 2 << 15
+const rotationMultiplier = 1 << 16 // fixed-point fractions of a turn
+const rotationTurnRange = math.MaxInt32 / rotationMultiplier
+const pathDeltaMultiplier = 16
 
 // build in anchors
 const (
@@ -28,70 +30,29 @@ const (
 	anchorMouse
 )
 
-// render operations
-const (
-	ropBeginPath = iota
-	ropSetFillColor
-	ropFill
-	ropMoveTo
-	ropLineTo
-	ropClosePath
-
-	ropMacroCall
-
-	ropUseAnchor
-
-	ropCodeCount
-)
-
-// update operations
-const (
-	uopMacroStart = iota
-	uopMacroEnd
-	uopMacroOperation
-	uopMacroVar
-	uopMacroUseVar
-	uopMacroUseConst
-
-	uopNodeCreate
-	uopNodeSetContent
-	uopNodeSetParent
-	uopNodeSetPosition
-	uopNodeSetRotation
-	uopNodeSetScale
-
-	uopAnchorCreate
-
-	// opCreatePseudoNode
-
-	// opContextCreate
-
-	uopCodeCount
-)
-
-var updateOpcodeNames = [254]string{
-	"uopMacroDefStart", "uopMacroDefEnd", "uopMacroDefOperation", "uopMacroDefVar",
-	"uopMacroDefUseVar", "uopMacroDefUseConst",
-
-	"uopNodeCreate", "uopNodeSetContent", "uopNodeSetParent", "uopNodeSetPosition", "uopNodeSetRotation", "uopNodeSetScale",
-}
-
-var renderOpcodeName = [256]string{
-	"ropBeginPath", "ropSetFillColor", "ropFill", "ropMoveTo", "ropLineTo", "ropClosePath", "ropMacroCall",
-}
-
 type AnchorNumber uint16
 type NodeNumber uint16
 type MacroNumber uint16
 
 type Bytecode struct {
-	bytes      []byte
-	i          int
-	lastOpcode uint8
-}
-
-func (b *Bytecode) error(description string) {
-	log.Fatal("i: ", b.i, " lastOpcode: ", b.lastOpcode, " error: ", description)
+	bytes        []byte
+	i            int
+	lastOpcode   uint8
+	varint       bool
+	numberFormat NumberFormat
+	reader       io.Reader // set for streaming bytecode, bytes is a window of what was read
+	discarded    int       // stream offset of bytes[0]
+}
+
+// error aborts decoding by panicking with a DecodeError, which the Client
+// recovers at the frame or node boundary.
+func (b *Bytecode) error(kind ErrorKind, description string) {
+	panic(&DecodeError{
+		kind:        kind,
+		offset:      b.offset(),
+		opcode:      b.lastOpcode,
+		description: description,
+	})
 }
 
 func NewBytecode() *Bytecode {
@@ -110,19 +71,49 @@ func NewBytecodeFromBytes(bytes []byte) *Bytecode {
 	return &bytecode
 }
 
+// encodeError aborts encoding by panicking with an EncodeError, which the
+// Server recovers at the frame boundary.
+func (b *Bytecode) encodeError(description string) {
+	panic(&EncodeError{description: description})
+}
+
+// applyHeader selects the operand encoding negotiated for the stream.
+func (b *Bytecode) applyHeader(header StreamHeader) *Bytecode {
+	b.varint = header.HasFeature(featureVarint)
+	b.numberFormat = header.numberFormat
+	return b
+}
+
 func (b *Bytecode) pushUint8(value uint8) {
 	b.bytes = append(b.bytes, value)
 }
 
 func (b *Bytecode) popUint8() uint8 {
+	b.need(1)
 	if b.i >= len(b.bytes) {
-		b.error("popUint8 out of range")
+		b.error(errorOutOfRange, "popUint8 out of range")
 	}
 	var value uint8 = b.bytes[b.i]
 	b.i += 1
 	return value
 }
 
+func (b *Bytecode) pushBytes(bytes []byte) {
+	b.bytes = append(b.bytes, bytes...)
+}
+
+// popBytes returns the next count bytes. For streaming bytecode they are only
+// valid until the next pop.
+func (b *Bytecode) popBytes(count int) []byte {
+	b.need(count)
+	if b.i+count > len(b.bytes) {
+		b.error(errorOutOfRange, "popBytes out of range")
+	}
+	bytes := b.bytes[b.i : b.i+count]
+	b.i += count
+	return bytes
+}
+
 func (s *Bytecode) pushUint16(value uint16) {
 	high := uint8(value >> 8)
 	low := uint8(value)
@@ -130,8 +121,9 @@ func (s *Bytecode) pushUint16(value uint16) {
 }
 
 func (b *Bytecode) popUint16() uint16 {
+	b.need(2)
 	if (b.i + 1) >= len(b.bytes) {
-		b.error("popUint16 out of range")
+		b.error(errorOutOfRange, "popUint16 out of range")
 	}
 	low := b.bytes[b.i]
 	high := b.bytes[b.i+1]
@@ -139,28 +131,109 @@ func (b *Bytecode) popUint16() uint16 {
 	return (uint16(high) << 8) + uint16(low)
 }
 
+func (b *Bytecode) pushInt8(value int8) {
+	b.pushUint8(uint8(value))
+}
+
+func (b *Bytecode) popInt8() int8 {
+	return int8(b.popUint8())
+}
+
+func (b *Bytecode) pushInt16(value int16) {
+	b.pushUint16(uint16(value))
+}
+
+func (b *Bytecode) popInt16() int16 {
+	return int16(b.popUint16())
+}
+
+func (b *Bytecode) pushUvarint(value uint64) {
+	var buffer [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buffer[:], value)
+	b.bytes = append(b.bytes, buffer[:n]...)
+}
+
+func (b *Bytecode) popUvarint() uint64 {
+	b.needVarint()
+	value, n := binary.Uvarint(b.bytes[b.i:])
+	if n == 0 {
+		b.error(errorOutOfRange, "popUvarint out of range")
+	} else if n < 0 {
+		b.error(errorOutOfRange, "popUvarint overflow")
+	}
+	b.i += n
+	return value
+}
+
+// pushVarint writes a zigzag encoded varint, small negative values stay short.
+func (b *Bytecode) pushVarint(value int64) {
+	var buffer [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buffer[:], value)
+	b.bytes = append(b.bytes, buffer[:n]...)
+}
+
+func (b *Bytecode) popVarint() int64 {
+	b.needVarint()
+	value, n := binary.Varint(b.bytes[b.i:])
+	if n == 0 {
+		b.error(errorOutOfRange, "popVarint out of range")
+	} else if n < 0 {
+		b.error(errorOutOfRange, "popVarint overflow")
+	}
+	b.i += n
+	return value
+}
+
+// pushId writes a 16 bit id, as a varint if the stream uses them.
+func (b *Bytecode) pushId(id uint16) {
+	if b.varint {
+		b.pushUvarint(uint64(id))
+	} else {
+		b.pushUint16(id)
+	}
+}
+
+func (b *Bytecode) popId() uint16 {
+	if !b.varint {
+		return b.popUint16()
+	}
+	id := b.popUvarint()
+	if id > math.MaxUint16 {
+		b.error(errorOutOfRange, "popId uint16 overflow")
+	}
+	return uint16(id)
+}
+
 func (b *Bytecode) pushNodeNumber(number NodeNumber) {
-	b.pushUint16(uint16(number))
+	b.pushId(uint16(number))
 }
 
 func (b *Bytecode) popNodeNumber() NodeNumber {
-	return NodeNumber(b.popUint16())
+	return NodeNumber(b.popId())
 }
 
 func (b *Bytecode) pushMacroNumber(number MacroNumber) {
-	b.pushUint16(uint16(number))
+	b.pushId(uint16(number))
 }
 
 func (b *Bytecode) popMacroNumber() MacroNumber {
-	return MacroNumber(b.popUint16())
+	return MacroNumber(b.popId())
 }
 
 func (b *Bytecode) pushAnchorNumber(number AnchorNumber) {
-	b.pushUint16(uint16(number))
+	b.pushId(uint16(number))
 }
 
 func (b *Bytecode) popAnchorNumber() AnchorNumber {
-	return AnchorNumber(b.popUint16())
+	return AnchorNumber(b.popId())
+}
+
+func (b *Bytecode) pushVariableNumber(number uint16) {
+	b.pushId(number)
+}
+
+func (b *Bytecode) popVariableNumber() uint16 {
+	return b.popId()
 }
 
 func (b *Bytecode) pushUint32(value uint32) {
@@ -172,8 +245,9 @@ func (b *Bytecode) pushUint32(value uint32) {
 }
 
 func (b *Bytecode) popUint32() uint32 {
+	b.need(4)
 	if (b.i + 3) >= len(b.bytes) {
-		b.error("popUint32 out of range")
+		b.error(errorOutOfRange, "popUint32 out of range")
 	}
 	b1 := b.bytes[b.i+3]
 	b2 := b.bytes[b.i+2]
@@ -183,6 +257,17 @@ func (b *Bytecode) popUint32() uint32 {
 	return (uint32(b1) << 24) + (uint32(b2) << 16) + (uint32(b3) << 8) + uint32(b4)
 }
 
+func (b *Bytecode) pushUint64(value uint64) {
+	b.pushUint32(uint32(value))
+	b.pushUint32(uint32(value >> 32))
+}
+
+func (b *Bytecode) popUint64() uint64 {
+	low := b.popUint32()
+	high := b.popUint32()
+	return (uint64(high) << 32) + uint64(low)
+}
+
 func (b *Bytecode) pushInt32(value int32) {
 	b1 := uint8(value >> 24) // highest, most significant
 	b2 := uint8(value >> 16)
@@ -192,26 +277,18 @@ func (b *Bytecode) pushInt32(value int32) {
 }
 
 func (b *Bytecode) popInt32() int32 {
+	b.need(4)
 	if (b.i + 3) >= len(b.bytes) {
-		b.error("popUint32 out of range")
+		b.error(errorOutOfRange, "popInt32 out of range")
 	}
 	b1 := b.bytes[b.i+3]
 	b2 := b.bytes[b.i+2]
 	b3 := b.bytes[b.i+1]
 	b4 := b.bytes[b.i]
 	b.i += 4
-	fmt.Println("popInt32: b1: ", b1, " b2: ", b2, " b3: ", b3, " b4: ", b4)
 	return (int32(b1) << 24) + (int32(b2) << 16) + (int32(b3) << 8) + int32(b4)
 }
 
-func (b *Bytecode) pushFloat64(value float64) {
-	b.pushInt32(int32(value * fixpointMultiplier))
-}
-
-func (b *Bytecode) popFloat64() float64 {
-	return float64(b.popInt32()) / fixpointMultiplier
-}
-
 func (b *Bytecode) pushOpcode(opcode uint8) {
 	b.pushUint8(opcode)
 }
@@ -224,9 +301,24 @@ func (b *Bytecode) popOpcode() uint8 {
 
 func (b *Bytecode) pushSize(size int) {
 	if size > math.MaxUint8 {
-		b.error("pushSize: size uint8 overflow")
+		b.encodeError("pushSize: size uint8 overflow")
+	}
+	if b.varint {
+		b.pushUvarint(uint64(size))
+	} else {
+		b.pushUint8(uint8(size))
 	}
-	b.pushUint8(uint8(size))
+}
+
+func (b *Bytecode) popSize() int {
+	if !b.varint {
+		return int(b.popUint8())
+	}
+	size := b.popUvarint()
+	if size > math.MaxUint8 {
+		b.error(errorOutOfRange, "popSize uint8 overflow")
+	}
+	return int(size)
 }
 
 func (b *Bytecode) pushVec2(point Vec2) {
@@ -238,6 +330,41 @@ func (b *Bytecode) popVec2() Vec2 {
 	return Vec2{X: b.popFloat64(), Y: b.popFloat64()}
 }
 
+// fitsDelta reports whether a path offset can be written exactly with the given
+// number of bits per component.
+func fitsDelta(delta Vec2, bits uint) bool {
+	limit := float64(int(1) << (bits - 1))
+	for _, component := range [2]float64{delta.X, delta.Y} {
+		scaled := component * pathDeltaMultiplier
+		if scaled != math.Round(scaled) || scaled < -limit || scaled >= limit {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Bytecode) pushDelta8(delta Vec2) {
+	b.pushInt8(int8(delta.X * pathDeltaMultiplier))
+	b.pushInt8(int8(delta.Y * pathDeltaMultiplier))
+}
+
+func (b *Bytecode) popDelta8() Vec2 {
+	x := b.popInt8()
+	y := b.popInt8()
+	return Vec2{X: float64(x), Y: float64(y)}.DivideFloat(pathDeltaMultiplier)
+}
+
+func (b *Bytecode) pushDelta16(delta Vec2) {
+	b.pushInt16(int16(delta.X * pathDeltaMultiplier))
+	b.pushInt16(int16(delta.Y * pathDeltaMultiplier))
+}
+
+func (b *Bytecode) popDelta16() Vec2 {
+	x := b.popInt16()
+	y := b.popInt16()
+	return Vec2{X: float64(x), Y: float64(y)}.DivideFloat(pathDeltaMultiplier)
+}
+
 // func (b *Bytecode) pushRect(value FixpointRect) {
 // 	b.pushUint16(value.X)
 // 	b.pushUint16(value.Y)
@@ -271,14 +398,51 @@ func (b *Bytecode) popRgba() nanovgo.Color {
 	return color
 }
 
+// pushRotation writes a signed rotation in 1/65536 turns. Multiple turns are
+// kept up to rotationTurnRange, beyond that whole turns are wrapped away.
 func (b *Bytecode) pushRotation(rotation float64) {
-	rotationUint := uint16(math.Abs(rotation/(math.Pi*2)) * math.MaxUint16)
-	b.pushUint16(rotationUint)
+	turns := rotation / (math.Pi * 2)
+	if math.IsNaN(turns) || math.IsInf(turns, 0) {
+		b.encodeError("pushRotation: invalid rotation " + formatFloat(rotation))
+	}
+	turns = math.Mod(turns, rotationTurnRange)
+	fixpoint := int32(math.Round(turns * rotationMultiplier))
+	if b.varint {
+		b.pushVarint(int64(fixpoint))
+	} else {
+		b.pushInt32(fixpoint)
+	}
 }
 
 func (b *Bytecode) popRotation() float64 {
-	rotationUint := b.popUint16()
-	return float64(rotationUint) / math.MaxUint16 * math.Pi * 2
+	var fixpoint int64
+	if b.varint {
+		fixpoint = b.popVarint()
+		if fixpoint < math.MinInt32 || fixpoint > math.MaxInt32 {
+			b.error(errorOutOfRange, "popRotation int32 overflow")
+		}
+	} else {
+		fixpoint = int64(b.popInt32())
+	}
+	return float64(fixpoint) / rotationMultiplier * math.Pi * 2
+}
+
+// pushAffine writes the two top rows of an affine matrix.
+func (b *Bytecode) pushAffine(m Matrix33) {
+	for _, value := range [6]float64{m.m00, m.m01, m.m02, m.m10, m.m11, m.m12} {
+		b.pushFloat64(value)
+	}
+}
+
+func (b *Bytecode) popAffine() Matrix33 {
+	m := Matrix33{m22: 1}
+	m.m00 = b.popFloat64()
+	m.m01 = b.popFloat64()
+	m.m02 = b.popFloat64()
+	m.m10 = b.popFloat64()
+	m.m11 = b.popFloat64()
+	m.m12 = b.popFloat64()
+	return m
 }
 
 func (b *Bytecode) pushScale(scale Vec2) {
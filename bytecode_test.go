@@ -0,0 +1,222 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// catchDecodeError runs pop and returns the DecodeError it raises.
+func catchDecodeError(pop func()) (err error) {
+	defer recoverDecodeError(&err)
+	pop()
+	return nil
+}
+
+// catchEncodeError runs push and returns the EncodeError it raises.
+func catchEncodeError(push func()) (err error) {
+	defer recoverEncodeError(&err)
+	push()
+	return nil
+}
+
+func isDecodeErrorKind(err error, kind ErrorKind) bool {
+	decodeError, ok := err.(*DecodeError)
+	return ok && decodeError.kind == kind
+}
+
+func TestVarintIdRoundTrip(t *testing.T) {
+	tests := []struct {
+		id   uint16
+		size int
+	}{
+		{0, 1}, {1, 1}, {127, 1}, {128, 2}, {16383, 2}, {16384, 3}, {math.MaxUint16, 3},
+	}
+	for _, test := range tests {
+		for _, varint := range []bool{false, true} {
+			b := NewBytecode()
+			b.varint = varint
+			b.pushNodeNumber(NodeNumber(test.id))
+			b.pushMacroNumber(MacroNumber(test.id))
+			size := 2
+			if varint {
+				size = test.size
+			}
+			if len(b.bytes) != 2*size {
+				t.Fatalf("id %d, varint %v: %d bytes, want %d", test.id, varint, len(b.bytes), 2*size)
+			}
+			if node, macro := b.popNodeNumber(), b.popMacroNumber(); uint16(node) != test.id || uint16(macro) != test.id {
+				t.Fatalf("id %d, varint %v: read %d and %d", test.id, varint, node, macro)
+			}
+		}
+	}
+
+	b := NewBytecode()
+	b.varint = true
+	b.pushUvarint(math.MaxUint16 + 1)
+	if err := catchDecodeError(func() { b.popId() }); !isDecodeErrorKind(err, errorOutOfRange) {
+		t.Fatalf("popId of %d returned %v, want an errorOutOfRange DecodeError", math.MaxUint16+1, err)
+	}
+	b = NewBytecodeFromBytes([]byte{0x80, 0x80})
+	b.varint = true
+	if err := catchDecodeError(func() { b.popId() }); !isDecodeErrorKind(err, errorOutOfRange) {
+		t.Fatalf("popId of a cut varint returned %v, want an errorOutOfRange DecodeError", err)
+	}
+}
+
+func TestVarintSizeRoundTrip(t *testing.T) {
+	tests := []struct {
+		size        int
+		encodedSize int
+	}{
+		{0, 1}, {127, 1}, {128, 2}, {math.MaxUint8, 2},
+	}
+	for _, test := range tests {
+		for _, varint := range []bool{false, true} {
+			b := NewBytecode()
+			b.varint = varint
+			b.pushSize(test.size)
+			encodedSize := 1
+			if varint {
+				encodedSize = test.encodedSize
+			}
+			if len(b.bytes) != encodedSize {
+				t.Fatalf("size %d, varint %v: %d bytes, want %d", test.size, varint, len(b.bytes), encodedSize)
+			}
+			if size := b.popSize(); size != test.size {
+				t.Fatalf("size %d, varint %v: read %d", test.size, varint, size)
+			}
+		}
+	}
+
+	b := NewBytecode()
+	b.varint = true
+	if err := catchEncodeError(func() { b.pushSize(math.MaxUint8 + 1) }); err == nil {
+		t.Fatal("pushSize of 256 didn't fail")
+	}
+	b.pushUvarint(math.MaxUint8 + 1)
+	if err := catchDecodeError(func() { b.popSize() }); !isDecodeErrorKind(err, errorOutOfRange) {
+		t.Fatalf("popSize of 256 returned %v, want an errorOutOfRange DecodeError", err)
+	}
+}
+
+func TestVarintCoordinateRoundTrip(t *testing.T) {
+	// zigzag encoding keeps -64..63 in one byte and -8192..8191 in two
+	const unit = 1.0 / (1 << 16)
+	tests := []struct {
+		value float64
+		size  int
+	}{
+		{0, 1},
+		{unit, 1},
+		{-unit, 1},
+		{63 * unit, 1},
+		{-64 * unit, 1},
+		{64 * unit, 2},
+		{-65 * unit, 2},
+		{8191 * unit, 2},
+		{-8192 * unit, 2},
+		{8192 * unit, 3},
+		{-8193 * unit, 3},
+		{-12.5, 3},
+		{32767, 5},
+		{-32768, 5},
+	}
+	for _, test := range tests {
+		for _, varint := range []bool{false, true} {
+			b := NewBytecode()
+			b.varint = varint
+			b.numberFormat = numberFormatFixed16
+			b.pushFloat64(test.value)
+			size := 4
+			if varint {
+				size = test.size
+			}
+			if len(b.bytes) != size {
+				t.Fatalf("%v, varint %v: %d bytes, want %d", test.value, varint, len(b.bytes), size)
+			}
+			if value := b.popFloat64(); value != test.value {
+				t.Fatalf("%v, varint %v: read %v", test.value, varint, value)
+			}
+		}
+	}
+
+	b := NewBytecode()
+	b.varint = true
+	b.numberFormat = numberFormatFixed16
+	b.pushVarint(math.MaxInt32 + 1)
+	if err := catchDecodeError(func() { b.popFloat64() }); !isDecodeErrorKind(err, errorOutOfRange) {
+		t.Fatalf("popFloat64 past int32 returned %v, want an errorOutOfRange DecodeError", err)
+	}
+}
+
+func TestRotationRoundTrip(t *testing.T) {
+	const step = math.Pi * 2 / rotationMultiplier
+	tests := []struct {
+		rotation float64
+		want     float64
+	}{
+		{0, 0},
+		{step, step},
+		{-step, -step},
+		{math.Pi / 2, math.Pi / 2},
+		{-math.Pi / 2, -math.Pi / 2},
+		{3.5 * math.Pi * 2, 3.5 * math.Pi * 2},
+		{-7.25 * math.Pi * 2, -7.25 * math.Pi * 2},
+		// whole turns past rotationTurnRange are wrapped away
+		{(rotationTurnRange + 1.25) * math.Pi * 2, 1.25 * math.Pi * 2},
+		{-(rotationTurnRange + 0.5) * math.Pi * 2, -0.5 * math.Pi * 2},
+	}
+	for _, test := range tests {
+		for _, varint := range []bool{false, true} {
+			b := NewBytecode()
+			b.varint = varint
+			b.pushRotation(test.rotation)
+			if !varint && len(b.bytes) != 4 {
+				t.Fatalf("%v: %d bytes, want 4", test.rotation, len(b.bytes))
+			}
+			if rotation := b.popRotation(); math.Abs(rotation-test.want) > step/2 {
+				t.Fatalf("%v, varint %v: read %v, want %v", test.rotation, varint, rotation, test.want)
+			}
+		}
+	}
+
+	b := NewBytecode()
+	b.varint = true
+	b.pushRotation(-math.Pi / 2)
+	if len(b.bytes) != 3 {
+		t.Fatalf("a quarter turn back takes %d varint bytes, want 3", len(b.bytes))
+	}
+	b = NewBytecode()
+	b.varint = true
+	b.pushVarint(math.MinInt32 - 1)
+	if err := catchDecodeError(func() { b.popRotation() }); !isDecodeErrorKind(err, errorOutOfRange) {
+		t.Fatalf("popRotation past int32 returned %v, want an errorOutOfRange DecodeError", err)
+	}
+	if err := catchEncodeError(func() { b.pushRotation(math.Inf(1)) }); err == nil {
+		t.Fatal("pushRotation of +Inf didn't fail")
+	}
+}
+
+func TestAffineRoundTrip(t *testing.T) {
+	m := Matrix33{
+		m00: 0.5, m01: -2, m02: 100.25,
+		m10: 1.5, m11: 0.75, m12: -40,
+		m20: 3, m21: 4, m22: 5, // not part of an affine transform
+	}
+	want := m
+	want.m20, want.m21, want.m22 = 0, 0, 1
+	for _, format := range []NumberFormat{numberFormatFixed16, numberFormatFloat32, numberFormatFloat64} {
+		for _, varint := range []bool{false, true} {
+			b := NewBytecode()
+			b.varint = varint
+			b.numberFormat = format
+			b.pushAffine(m)
+			if affine := b.popAffine(); affine != want {
+				t.Fatalf("%s, varint %v: read %v, want %v", format, varint, affine, want)
+			}
+			if b.more() {
+				t.Fatalf("%s, varint %v: %d bytes left", format, varint, len(b.bytes)-b.i)
+			}
+		}
+	}
+}
@@ -1,21 +1,27 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
-	"log"
+	"io"
 	"math"
 
 	"github.com/shibukawa/nanovgo"
 )
 
+var debug = false
+
+// maxMacroCallDepth bounds how deeply macros may call macros while rendering.
+const maxMacroCallDepth = 32
+
 func debugPrint(i ...interface{}) {
-	if true {
+	if debug {
 		fmt.Println(i...)
 	}
 }
 
 func debugPrint2(i ...interface{}) {
-	if true {
+	if debug {
 		fmt.Println(i...)
 	}
 }
@@ -30,28 +36,61 @@ type Macro struct {
 	bytecode *Bytecode
 
 	variableReferences   []FunctionVariableReference
+	variableTypes        []OperandType
 	variableSizes        []int
 	variableStartIndexes []int
 	totalVariablesSize   int
+
+	pending []OperandType // operands of the last operation still to be given, while defined
+	opcode  uint8         // the last operation, while defined
+	blocks  int           // open repeat and if blocks, while defined
+
+	calls []MacroNumber // macros the bytecode calls, once for every call
 }
 
-func NewMacro() *Macro {
+func NewMacro(numberFormat NumberFormat) *Macro {
+	bytecode := NewBytecode()
+	bytecode.numberFormat = numberFormat
 	return &Macro{
-		bytecode:           NewBytecode(),
+		bytecode:           bytecode,
 		variableSizes:      []int{},
 		totalVariablesSize: 0,
 		variableReferences: []FunctionVariableReference{},
 	}
 }
 
+// snapshot returns a function that restores the macro to its current state.
+func (f *Macro) snapshot() func() {
+	saved := *f
+	savedBytecode := *f.bytecode
+	return func() {
+		*f = saved
+		*f.bytecode = savedBytecode
+	}
+}
+
+// Patch writes a new value of one variable into bytecode compiled from the
+// macro.
+func (f *Macro) Patch(bytecode *Bytecode, variableNumber uint16, value []byte) {
+	for _, variableReference := range f.variableReferences {
+		if variableReference.variableNumber == variableNumber {
+			copy(bytecode.bytes[variableReference.bytecodeIndex:], value)
+		}
+	}
+}
+
+// Compile returns the render bytecode of one use of the macro with the given
+// variable values. Every use gets its own copy, the macro's bytecode is never
+// written to.
 func (f *Macro) Compile(variables []byte) *Bytecode {
-	bytes := f.bytecode.bytes
+	bytes := append([]byte(nil), f.bytecode.bytes...)
 	for _, variableReference := range f.variableReferences {
 		for i := 0; i < f.variableSizes[variableReference.variableNumber]; i++ {
 			bytes[variableReference.bytecodeIndex+i] = variables[variableReference.variableStartIndex+i]
 		}
 	}
 	bytecode := NewBytecodeFromBytes(bytes)
+	bytecode.numberFormat = f.bytecode.numberFormat
 	return bytecode
 }
 
@@ -93,6 +132,14 @@ func BuildScaleMatrix(scale Vec2) Matrix33 {
 	}
 }
 
+func BuildAffineMatrix(a, b, c, d, tx, ty float64) Matrix33 {
+	return Matrix33{
+		a, b, tx,
+		c, d, ty,
+		0, 0, 1,
+	}
+}
+
 func BuildTransformationMatrix(translation Vec2, rotation float64, scale Vec2) Matrix33 {
 	translationMatrix := BuildTranslationMatrix(translation)
 	rotationMatrix := BuildRotationMatrix(rotation)
@@ -123,16 +170,39 @@ func (t Matrix33) MultiplyVec2(p Vec2) Vec2 {
 	}
 }
 
+// Inverse returns the inverse of an affine matrix, ok is false if the matrix
+// is singular.
+func (t Matrix33) Inverse() (inverse Matrix33, ok bool) {
+	det := t.m00*t.m11 - t.m01*t.m10
+	if det == 0 {
+		return Matrix33{}, false
+	}
+	return Matrix33{
+		m00: t.m11 / det,
+		m01: -t.m01 / det,
+		m02: (t.m01*t.m12 - t.m11*t.m02) / det,
+		m10: -t.m10 / det,
+		m11: t.m00 / det,
+		m12: (t.m10*t.m02 - t.m00*t.m12) / det,
+		m22: 1,
+	}, true
+}
+
 // func (t Matrix33) MultiplyPoint(p Point) Point {
 // 	return t.MultiplyHomoPoint(p.ToHomoPoint()).ToPoint()
 // }
 
 type Node struct {
 	renderCode    *Bytecode
+	content       *Macro // the macro renderCode is compiled from, recompiled when it's redefined
+	contentArgs   []byte
 	localToGlobal Matrix33
 	position      Vec2
 	rotation      float64
 	scale         Vec2
+	transform     Matrix33 // replaces position, rotation and scale when hasTransform is set
+	hasTransform  bool
+	pivot         Vec2 // local point that is placed at position and rotated and scaled around
 	parent        *Node
 	children      map[*Node]struct{}
 }
@@ -152,8 +222,16 @@ func (n *Node) AddChild(child *Node) {
 	n.children[child] = struct{}{}
 }
 
+func (n *Node) LocalMatrix() Matrix33 {
+	local := n.transform
+	if !n.hasTransform {
+		local = BuildTransformationMatrix(n.position, n.rotation, n.scale)
+	}
+	return local.MultiplyMatrix(BuildTranslationMatrix(n.pivot.MultiplyFloat(-1)))
+}
+
 func (n *Node) UpdateLocalToGlobalMatrix() {
-	transformationMatrix := BuildTransformationMatrix(n.position, n.rotation, n.scale)
+	transformationMatrix := n.LocalMatrix()
 	if n.parent != nil {
 		n.localToGlobal = n.parent.localToGlobal.MultiplyMatrix(transformationMatrix)
 	} else {
@@ -161,6 +239,15 @@ func (n *Node) UpdateLocalToGlobalMatrix() {
 	}
 }
 
+// GlobalMatrix computes the local to global matrix from the current transforms
+// of the node and its parents, without waiting for the next render.
+func (n *Node) GlobalMatrix() Matrix33 {
+	if n.parent == nil {
+		return n.LocalMatrix()
+	}
+	return n.parent.GlobalMatrix().MultiplyMatrix(n.LocalMatrix())
+}
+
 func (n *Node) TransformPoint(point Vec2) Vec2 {
 	return n.localToGlobal.MultiplyVec2(point)
 }
@@ -179,92 +266,512 @@ type Anchor struct {
 
 type Client struct {
 	*Bytecode
-	updateOperations [256]func()
-	renderOperations [256]func(*Node)
-	nvgCtx           *nanovgo.Context
-	stack            []*Bytecode
-	macros           map[MacroNumber]*Macro
-	wipMacro         *Macro
-	wipMacroNumber   MacroNumber
-	nodes            map[NodeNumber]*Node
-	anchors          map[AnchorNumber]*Anchor
-	root             *Node
+	updateOperations [uopCodeCount]func()
+	renderOperations [ropCodeCount]func(*Node)
+
+	extendedUpdateOperations map[ExtendedCode]func()
+	extendedRenderOperations map[ExtendedCode]func(*Node)
+	warnings                 map[string]bool
+
+	nvgCtx          *nanovgo.Context
+	path            pathDrawer // nvgCtx, except in tests checking what is drawn
+	stack           []*Bytecode
+	macros          map[MacroNumber]*Macro
+	macroCallers    map[MacroNumber]int // calls of a macro number in the bytecode of defined macros
+	library         *MacroLibrary
+	wipMacro        *Macro
+	wipMacroNumber  MacroNumber
+	nodes           map[NodeNumber]*Node
+	anchors         map[AnchorNumber]*Anchor
+	root            *Node
+	features        uint32
+	header          StreamHeader
+	handshakeDone   bool
+	frames          FrameDecoder
+	stream          *Bytecode // streaming bytecode of the reader given to ReadFrame
+	streamReader    io.Reader
+	dictionary      compressionDictionary
+	nextSequence    uint32
+	lastFrameTime   uint32
+	droppedFrames   int // frames that failed to decode and were rolled back
+	corruptedFrames int // frames that failed their checksum and weren't applied
+	undo            []func()
+	values          []float64   // value stack of the render code, see expression.go
+	blocks          []block     // open repeat and if blocks of the render code, see control.go
+	renderSteps     int         // render operations run by the current Render
+	stroke          strokeState // stroke state of the render code, see stroke.go
+	pathPoint       Vec2        // current point of the path in node coordinates
+	subpathStart    Vec2
+	pathStarted     bool // a subpath has been started since beginPath
+}
+
+// pathDrawer takes the path of the render code in window coordinates.
+type pathDrawer interface {
+	MoveTo(x, y float32)
+	LineTo(x, y float32)
+	BezierTo(c1x, c1y, c2x, c2y, x, y float32)
+	ClosePath()
 }
 
 func NewClient(nvgCtx *nanovgo.Context) *Client {
 	client := Client{
 		Bytecode: NewBytecode(),
 		nvgCtx:   nvgCtx,
+		path:     nvgCtx,
 		stack:    []*Bytecode{},
 		macros:   map[MacroNumber]*Macro{},
 		nodes:    map[NodeNumber]*Node{},
+		anchors:  map[AnchorNumber]*Anchor{},
 		root:     NewNode(),
-	}
-	client.updateOperations = [256]func(){
-		client.macroDefStart, client.macroDefEnd, client.macroDefOperation, client.macroDefVar,
-		client.macroDefUseVar, client.macroDefUseConst,
+		features: supportedFeatures,
 
-		client.nodeCreate, client.nodeSetContent, client.nodeSetParent, client.nodeSetPosition, client.nodeSetRotation, client.nodeSetScale,
+		macroCallers:             map[MacroNumber]int{},
+		extendedUpdateOperations: map[ExtendedCode]func(){},
+		extendedRenderOperations: map[ExtendedCode]func(*Node){},
+		warnings:                 map[string]bool{},
+	}
+	client.updateOperations = [uopCodeCount]func(){
+		uopMacroStart:       client.macroDefStart,
+		uopMacroEnd:         client.macroDefEnd,
+		uopMacroOperation:   client.macroDefOperation,
+		uopMacroVar:         client.macroDefVar,
+		uopMacroUseVar:      client.macroDefUseVar,
+		uopMacroUseConst:    client.macroDefUseConst,
+		uopNodeCreate:       client.nodeCreate,
+		uopNodeSetContent:   client.nodeSetContent,
+		uopNodeSetParent:    client.nodeSetParent,
+		uopNodeSetPosition:  client.nodeSetPosition,
+		uopNodeSetRotation:  client.nodeSetRotation,
+		uopNodeSetScale:     client.nodeSetScale,
+		uopAnchorCreate:     client.anchorCreate,
+		uopNodeSetTransform: client.nodeSetTransform,
+		uopNodeSetPivot:     client.nodeSetPivot,
+		uopExtended:         client.updateExtended,
+		uopMacroDelete:      client.macroDelete,
+		uopNodeSetArgument:  client.nodeSetArgument,
+		uopMacroLoad:        client.macroLoad,
+	}
+	client.renderOperations = [ropCodeCount]func(*Node){
+		ropBeginPath:        client.beginPath,
+		ropSetFillColor:     client.setFillColor,
+		ropFill:             client.fill,
+		ropMoveTo:           client.moveTo,
+		ropLineTo:           client.lineTo,
+		ropClosePath:        client.closePath,
+		ropMacroCall:        client.macroCall,
+		ropUseAnchor:        client.useAnchor,
+		ropMoveToRelative:   client.moveToRelative,
+		ropLineToRelative:   client.lineToRelative,
+		ropMoveToDelta8:     client.moveToDelta8,
+		ropLineToDelta8:     client.lineToDelta8,
+		ropMoveToDelta16:    client.moveToDelta16,
+		ropLineToDelta16:    client.lineToDelta16,
+		ropExtended:         client.renderExtended,
+		ropPushNumber:       client.pushNumber,
+		ropPushVec2:         client.pushVec2,
+		ropPushRgba:         client.pushRgba,
+		ropAdd:              client.binaryOperation(func(a, b float64) float64 { return a + b }),
+		ropMultiply:         client.binaryOperation(func(a, b float64) float64 { return a * b }),
+		ropNegate:           client.unaryOperation(func(a float64) float64 { return -a }),
+		ropMin:              client.binaryOperation(math.Min),
+		ropMax:              client.binaryOperation(math.Max),
+		ropSin:              client.unaryOperation(math.Sin),
+		ropCos:              client.unaryOperation(math.Cos),
+		ropApply:            client.apply,
+		ropRepeat:           client.repeat,
+		ropIf:               client.ifNonZero,
+		ropEnd:              client.end,
+		ropPushIndex:        client.pushIndex,
+		ropSetStrokeColor:   client.setStrokeColor,
+		ropSetStrokeWidth:   client.setStrokeWidth,
+		ropSetLineCap:       client.setLineCap,
+		ropSetLineJoin:      client.setLineJoin,
+		ropSetMiterLimit:    client.setMiterLimit,
+		ropSetStrokeScaling: client.setStrokeScaling,
+		ropStroke:           client.strokePath,
+		ropBezierTo:         client.bezierTo,
+		ropQuadTo:           client.quadTo,
+		ropArcTo:            client.arcTo,
+		ropArc:              client.arc,
+		ropEllipse:          client.ellipse,
+		ropRect:             client.rect,
+		ropRoundedRect:      client.roundedRect,
 	}
-	client.renderOperations = [256]func(*Node){
-		client.beginPath, client.setFillColor, client.fill, client.moveTo, client.lineTo, client.closePath,
-		client.macroCall,
+	client.installExtensions()
+	for opcode, operation := range client.updateOperations {
+		if operation == nil {
+			panic("NewClient: no handler for " + opcodeName(false, uint8(opcode)))
+		}
+	}
+	for opcode, operation := range client.renderOperations {
+		if operation == nil {
+			panic("NewClient: no handler for " + opcodeName(true, uint8(opcode)))
+		}
 	}
 	return &client
 }
 
-func (c *Client) error(description string) {
-	log.Fatal(description)
+// error aborts the current frame or node with a DecodeError. It works between
+// updates too, when there is no bytecode to take the offset from.
+func (c *Client) error(kind ErrorKind, description string) {
+	if c.Bytecode == nil {
+		panic(&DecodeError{kind: kind, offset: -1, description: description})
+	}
+	c.Bytecode.error(kind, description)
 }
 
-func (c *Client) Update(bytecode *Bytecode) {
-	debugPrint2("update bytes: ", bytecode.bytes)
-	c.Bytecode = bytecode
+// record adds a function to the undo journal of the frame being applied. Every
+// update operation that changes client state records how to revert it.
+func (c *Client) record(undo func()) {
+	c.undo = append(c.undo, undo)
+}
+
+// recordNode records the current state of a node, including its parent.
+func (c *Client) recordNode(node *Node) {
+	saved := *node
+	c.record(func() {
+		if node.parent != saved.parent {
+			saved.parent.AddChild(node)
+		}
+		*node = saved
+	})
+}
+
+func (c *Client) rollback() {
+	for i := len(c.undo) - 1; i >= 0; i-- {
+		c.undo[i]()
+	}
+	c.undo = c.undo[:0]
+}
+
+// Handshake validates the server's stream header and returns the answer with
+// the features both sides support.
+func (c *Client) Handshake(offer []byte) ([]byte, error) {
+	header, err := DecodeStreamHeader(offer)
+	if err != nil {
+		return nil, err
+	}
+	header.features &= c.features
+	c.header = header
+	answer := NewBytecodeFromBytes(EncodeStreamHeader(header))
+	if header.HasFeature(featureLibrary) {
+		offered, err := decodeMacroHashes(offer)
+		if err != nil {
+			return nil, err
+		}
+		answer.pushMacroHashes(c.missingLibraryMacros(offered))
+	}
+	c.frames.varint = header.HasFeature(featureVarint)
+	c.frames.checksum = header.HasFeature(featureChecksum)
+	c.handshakeDone = true
+	return answer.bytes, nil
+}
+
+// Update consumes stream bytes, which may end in the middle of a frame, and
+// applies every complete frame. Discontinuities in the frame sequence are
+// returned; frames older than the expected one are dropped. A frame that fails
+// to decode is rolled back as a whole and the first such error is returned, so
+// the client keeps the last good scene.
+func (c *Client) Update(bytes []byte) ([]FrameGap, error) {
+	if !c.handshakeDone {
+		return nil, &DecodeError{kind: errorInvalidState, offset: -1, description: "Update before handshake"}
+	}
+	gaps := []FrameGap{}
+	var firstErr error
+	c.frames.Write(bytes)
 	for {
-		for c.i < len(c.bytes) {
+		frame, ok, err := c.frames.Next()
+		if isChecksumError(err) || err != nil && c.frames.resync {
+			c.corruptedFrames++
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if err != nil {
+			// without a valid frame header the rest of the buffer can't be split
+			c.frames.buffered = nil
+			return gaps, err
+		}
+		if !ok {
+			return gaps, firstErr
+		}
+		var apply bool
+		if gaps, apply = c.checkSequence(frame, gaps); !apply {
+			continue
+		}
+		if err := c.applyFrame(frame); err != nil {
+			c.droppedFrames++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+}
+
+// ReadFrame reads the next frame from r and applies it while it arrives. Pass
+// the same reader for the whole stream, bytes read past the frame are kept for
+// the next call. At the end of the stream io.EOF is returned. Gaps and decode
+// errors are handled as in Update.
+func (c *Client) ReadFrame(r io.Reader) (gaps []FrameGap, err error) {
+	if !c.handshakeDone {
+		return nil, &DecodeError{kind: errorInvalidState, offset: -1, description: "ReadFrame before handshake"}
+	}
+	if c.stream == nil || c.streamReader != r {
+		c.stream = NewBytecodeFromReader(r)
+		c.stream.varint = c.header.HasFeature(featureVarint)
+		c.streamReader = r
+	}
+	var length int
+	var frame Frame
+	err = func() (err error) {
+		defer recoverDecodeError(&err)
+		if !c.stream.more() {
+			return io.EOF
+		}
+		length, frame = c.stream.popFrameHeader()
+		return nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+	if c.header.HasFeature(featureChecksum) {
+		return c.readCheckedFrame(length, frame)
+	}
+	payload := &payloadReader{reader: c.stream, remaining: length}
+	gaps, apply := c.checkSequence(frame, gaps)
+	if apply {
+		if err = c.readPayload(frame.sequence, payload); err != nil {
+			c.droppedFrames++
+		}
+	}
+	// skip whatever the frame didn't read to get to the next frame header
+	if _, skipErr := io.Copy(io.Discard, payload); skipErr != nil && err == nil {
+		err = skipErr
+	}
+	return gaps, err
+}
+
+// readCheckedFrame reads the whole payload of a frame and its checksum, and
+// only applies the frame if the checksum matches.
+func (c *Client) readCheckedFrame(length int, frame Frame) (gaps []FrameGap, err error) {
+	frame.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.stream, frame.payload); err != nil {
+		if err == io.EOF {
+			err = errTruncatedFrame
+		}
+		return nil, err
+	}
+	var expected uint32
+	err = func() (err error) {
+		defer recoverDecodeError(&err)
+		expected = c.stream.popUint32()
+		return nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+	header := NewBytecode().applyHeader(c.header)
+	header.pushFrameHeader(length, frame)
+	if computed := frameChecksum(header.bytes, frame.payload); computed != expected {
+		c.corruptedFrames++
+		return nil, checksumError(expected, computed)
+	}
+	gaps, apply := c.checkSequence(frame, gaps)
+	if apply {
+		if err = c.applyFrame(frame); err != nil {
+			c.droppedFrames++
+		}
+	}
+	return gaps, err
+}
+
+func (c *Client) readPayload(sequence uint32, payload io.Reader) error {
+	if !c.header.HasFeature(featureCompression) {
+		return c.applyPayload(NewBytecodeFromReader(payload))
+	}
+	operations, err := c.dictionary.decompress(sequence, payload)
+	if err != nil {
+		c.dictionary.lost = true
+		return err
+	}
+	// the dictionary needs the operations after they've been applied
+	var applied bytes.Buffer
+	operations = io.TeeReader(&sizeLimitReader{reader: operations, remaining: maxFrameSize}, &applied)
+	if err := c.applyPayload(NewBytecodeFromReader(operations)); err != nil {
+		c.dictionary.lost = true
+		return err
+	}
+	c.dictionary.commit(sequence, applied.Bytes())
+	return nil
+}
+
+// checkSequence adds a discontinuity before the frame to gaps and reports
+// whether the frame should be applied: frames older than the expected one are
+// dropped.
+func (c *Client) checkSequence(frame Frame, gaps []FrameGap) ([]FrameGap, bool) {
+	if frame.sequence != c.nextSequence {
+		gap := FrameGap{expected: c.nextSequence, received: frame.sequence}
+		gaps = append(gaps, gap)
+		if gap.Reordered() {
+			return gaps, false
+		}
+	}
+	c.nextSequence = frame.sequence + 1
+	c.lastFrameTime = frame.timestamp
+	return gaps, true
+}
+
+func (c *Client) applyFrame(frame Frame) error {
+	debugPrint2("update bytes: ", frame.payload)
+	if !c.header.HasFeature(featureCompression) {
+		return c.applyPayload(NewBytecodeFromBytes(frame.payload))
+	}
+	operations, err := c.dictionary.decompressBytes(frame.sequence, frame.payload)
+	if err != nil {
+		c.dictionary.lost = true
+		return err
+	}
+	if err := c.applyPayload(NewBytecodeFromBytes(operations)); err != nil {
+		c.dictionary.lost = true
+		return err
+	}
+	c.dictionary.commit(frame.sequence, operations)
+	return nil
+}
+
+// KeyFrameNeeded reports whether a compressed frame was lost, so the frames
+// after it can't be decoded until a key frame. Pass it on to the server's
+// RequestKeyFrame to recover before the next periodic key frame.
+func (c *Client) KeyFrameNeeded() bool {
+	return c.dictionary.lost
+}
+
+// applyPayload runs the update operations of a frame. If one fails the whole
+// frame is rolled back.
+func (c *Client) applyPayload(payload *Bytecode) (err error) {
+	c.undo = c.undo[:0]
+	c.dictionary.definitions = nil
+	wipMacro, wipMacroNumber := c.wipMacro, c.wipMacroNumber
+	c.record(func() {
+		c.wipMacro, c.wipMacroNumber = wipMacro, wipMacroNumber
+	})
+	if wipMacro != nil {
+		c.record(wipMacro.snapshot())
+	}
+	defer func() {
+		if err != nil {
+			c.rollback()
+			c.resetState()
+		}
+	}()
+	defer recoverDecodeError(&err)
+
+	c.Bytecode = payload.applyHeader(c.header)
+	for {
+		for c.more() {
 			c.updateStep()
 		}
 		if !c.popState() {
-			return
+			c.undo = c.undo[:0]
+			return nil
 		}
 	}
 }
 
 func (c *Client) updateStep() {
 	opcode := c.popOpcode()
-	if opcode > uopCodeCount {
-		c.error("invalid update opcode: " + fmt.Sprint(opcode))
+	if opcode >= uopCodeCount {
+		c.error(errorUnknownOpcode, "invalid update opcode: "+fmt.Sprint(opcode))
 	}
-	debugPrint("i: ", c.i-1, " opcode: ", updateOpcodeNames[opcode])
-	c.updateOperations[opcode]()
+	debugPrint("i: ", c.i-1, " opcode: ", opcodeName(false, opcode))
+	c.checkOperands(updateOpcodes[opcode], c.updateOperations[opcode])
 }
 
-func (c *Client) Render() {
+// checkOperands runs an operation and fails if it read a different number of
+// bytes than its description in the opcode tables says it has.
+func (c *Client) checkOperands(description Opcode, operation func()) {
+	if c.reader != nil {
+		// streaming bytes can't be read twice
+		operation()
+		return
+	}
+	bytecode := *c.Bytecode
+	operation()
+	end := bytecode.skipOperands(description.operands, func(macroNumber MacroNumber) int {
+		if macro, ok := c.macros[macroNumber]; ok {
+			return macro.totalVariablesSize
+		}
+		return 0
+	})
+	if end != c.i {
+		c.error(errorInvalidState, fmt.Sprint(description.name, " read ", c.i-bytecode.i, " operand bytes, described as ", end-bytecode.i))
+	}
+}
+
+// Render draws every node. A node whose render code fails to decode is skipped
+// and the first error is returned.
+func (c *Client) Render() error {
 	debugPrint("Render start")
-	c.renderNode(c.root)
+	c.renderSteps = 0
+	return c.renderNode(c.root)
 }
 
-func (c *Client) renderNode(node *Node) {
+func (c *Client) renderNode(node *Node) error {
 	if node == nil {
-		return
+		return nil
 	}
 	node.UpdateLocalToGlobalMatrix()
-	if node.renderCode != nil {
-		c.pushState(node.renderCode)
-		for c.i < len(c.bytes) {
-			c.renderStep(node)
+	err := c.renderContent(node)
+	for child := range node.children {
+		if childErr := c.renderNode(child); err == nil {
+			err = childErr
 		}
 	}
-	for child := range node.children {
-		c.renderNode(child)
+	return err
+}
+
+func (c *Client) renderContent(node *Node) (err error) {
+	if node.renderCode == nil {
+		return nil
+	}
+	bytecode, depth := c.Bytecode, len(c.stack)
+	defer func() {
+		if err != nil {
+			err.(*DecodeError).render = true
+			c.Bytecode, c.stack = bytecode, c.stack[:depth]
+		}
+	}()
+	defer recoverDecodeError(&err)
+
+	c.values, c.blocks, c.stroke = c.values[:0], c.blocks[:0], defaultStroke
+	c.pathPoint, c.subpathStart, c.pathStarted = Vec2{}, Vec2{}, false
+	c.pushState(node.renderCode)
+	c.renderMacro(node)
+	return nil
+}
+
+// renderMacro runs the render bytecode on top of the stack to its end, then
+// returns to the caller's bytecode.
+func (c *Client) renderMacro(node *Node) {
+	for c.more() {
+		c.renderStep(node)
+	}
+	if len(c.blocks) > 0 && c.blocks[len(c.blocks)-1].bytecode == c.Bytecode {
+		c.error(errorInvalidState, "render code ends inside a block")
 	}
+	c.popState()
 }
 
 func (c *Client) renderStep(node *Node) {
 	opcode := c.popOpcode()
-	debugPrint("i: ", c.i-1, " opcode: ", renderOpcodeName[opcode])
-	if opcode > ropCodeCount {
-		c.error("invalid render opcode: " + fmt.Sprint(opcode))
+	debugPrint("i: ", c.i-1, " opcode: ", opcodeName(true, opcode))
+	if opcode >= ropCodeCount {
+		c.error(errorUnknownOpcode, "invalid render opcode: "+fmt.Sprint(opcode))
+	}
+	c.renderSteps++
+	if c.renderSteps > maxRenderSteps {
+		c.error(errorOutOfRange, "render ran more than "+fmt.Sprint(maxRenderSteps)+" operations")
 	}
 	c.renderOperations[opcode](node)
 }
@@ -272,7 +779,7 @@ func (c *Client) renderStep(node *Node) {
 func (c *Client) pushState(bytecode *Bytecode) {
 	debugPrint("push state, c.Bytecode == nil: ", c.Bytecode == nil)
 	if bytecode == nil {
-		c.error("pushState nil bytecode")
+		c.error(errorInvalidState, "pushState nil bytecode")
 	}
 	if c.Bytecode != nil {
 		c.stack = append(c.stack, c.Bytecode)
@@ -281,11 +788,15 @@ func (c *Client) pushState(bytecode *Bytecode) {
 	c.Bytecode = bytecode
 }
 
+func (c *Client) resetState() {
+	c.stack = []*Bytecode{}
+	c.Bytecode = nil
+}
+
 func (c *Client) popState() bool {
 	debugPrint("pop state len(c.stack): ", len(c.stack))
 	if len(c.stack) == 0 {
-		c.stack = []*Bytecode{}
-		c.Bytecode = nil
+		c.resetState()
 		return false
 	}
 	topIndex := len(c.stack) - 1
@@ -299,21 +810,16 @@ func (c *Client) popAndCompileMacro() *Bytecode {
 	macroNumber := c.popMacroNumber()
 	macro, ok := c.macros[macroNumber]
 	if !ok {
-		c.error("popAndCompileMacro: invalid macroNumber: " + fmt.Sprint(macroNumber))
-	}
-	if c.i+macro.totalVariablesSize > len(c.bytes) {
-		c.error("popAndCompileMacro: macro variable block out of range")
+		c.error(errorUnknownMacro, "popAndCompileMacro: invalid macroNumber: "+fmt.Sprint(macroNumber))
 	}
-	variables := c.bytes[c.i : c.i+macro.totalVariablesSize]
-	c.i += len(variables)
-	return macro.Compile(variables)
+	return macro.Compile(c.popBytes(macro.totalVariablesSize))
 }
 
 func (c *Client) popNode() *Node {
 	nodeNumber := c.popNodeNumber()
 	node, ok := c.nodes[nodeNumber]
 	if !ok {
-		c.error("popNode: invalid nodeNumber")
+		c.error(errorUnknownNode, "popNode: invalid nodeNumber: "+fmt.Sprint(nodeNumber))
 	}
 	return node
 }
@@ -328,11 +834,12 @@ func (c *Client) popNode() *Node {
 // ---------------------UPDATE OPERATIONS---------------------
 
 func (c *Client) macroDefStart() {
+	c.dictionary.startDefinition(c.offset() - 1)
 	if c.wipMacro != nil {
-		c.error("macroDefStart: wip function already in progress")
+		c.error(errorInvalidState, "macroDefStart: wip function already in progress")
 	}
 	macroNumber := c.popMacroNumber()
-	newWipMacro := NewMacro()
+	newWipMacro := NewMacro(c.header.numberFormat)
 	c.wipMacro = newWipMacro
 	c.wipMacroNumber = macroNumber
 	debugPrint("funDefStart functionNumber: ", macroNumber)
@@ -340,25 +847,143 @@ func (c *Client) macroDefStart() {
 
 func (c *Client) macroDefEnd() {
 	if c.wipMacro == nil {
-		c.error("macroDefEnd: nil wip function")
+		c.error(errorInvalidState, "macroDefEnd: nil wip function")
+	}
+	c.checkOperandsGiven("macroDefEnd")
+	if c.wipMacro.blocks > 0 {
+		c.error(errorInvalidState, fmt.Sprint("macroDefEnd: ", c.wipMacro.blocks, " blocks aren't ended"))
 	}
-	c.macros[c.wipMacroNumber] = c.wipMacro
+	c.dictionary.endDefinition(c.offset())
+	macro := c.wipMacro
 	c.wipMacro = nil
+	c.installMacro(c.wipMacroNumber, macro)
+}
+
+// installMacro defines or redefines a macro.
+func (c *Client) installMacro(macroNumber MacroNumber, macro *Macro) {
+	old, redefined := c.macros[macroNumber]
+	if redefined && !sameOperandTypes(macro.variableTypes, old.variableTypes) {
+		// calls and node contents carry arguments for the old variables
+		if c.macroCallers[macroNumber] > 0 {
+			c.error(errorInvalidState, fmt.Sprint("installMacro: redefinition of macro ", macroNumber, " called by other macros changes its variables"))
+		}
+		for _, node := range c.nodes {
+			if node.content == old {
+				c.error(errorInvalidState, fmt.Sprint("installMacro: redefinition of macro ", macroNumber, " used by nodes changes its variables"))
+			}
+		}
+	}
+	c.macros[macroNumber] = macro
+	if redefined {
+		c.record(func() { c.macros[macroNumber] = old })
+		c.addCalls(old.calls, -1)
+	} else {
+		c.record(func() { delete(c.macros, macroNumber) })
+	}
+	c.addCalls(macro.calls, 1)
+	if !redefined {
+		return
+	}
+	for _, node := range c.nodes {
+		if node.content == old {
+			c.recordNode(node)
+			node.content = macro
+			node.renderCode = macro.Compile(node.contentArgs)
+		}
+	}
+}
+
+// addCalls adds delta to the count of callers of every called macro.
+func (c *Client) addCalls(calls []MacroNumber, delta int) {
+	for _, macroNumber := range calls {
+		macroNumber := macroNumber
+		c.macroCallers[macroNumber] += delta
+		c.record(func() { c.macroCallers[macroNumber] -= delta })
+	}
+}
+
+// macroDelete frees a macro. Nodes showing it keep their content, but no
+// longer follow redefinitions of its number. A macro that other macros call
+// can't be deleted.
+func (c *Client) macroDelete() {
+	macroNumber := c.popMacroNumber()
+	macro, ok := c.macros[macroNumber]
+	if !ok {
+		c.error(errorUnknownMacro, "macroDelete: invalid macroNumber: "+fmt.Sprint(macroNumber))
+	}
+	callers := c.macroCallers[macroNumber]
+	for _, called := range macro.calls {
+		if called == macroNumber {
+			callers--
+		}
+	}
+	if callers > 0 {
+		c.error(errorInvalidState, fmt.Sprint("macroDelete: macro ", macroNumber, " is still called ", callers, " times by other macros"))
+	}
+	delete(c.macros, macroNumber)
+	c.record(func() { c.macros[macroNumber] = macro })
+	c.addCalls(macro.calls, -1)
+	for _, node := range c.nodes {
+		if node.content == macro {
+			c.recordNode(node)
+			node.content, node.contentArgs = nil, nil
+		}
+	}
 }
 
 func (c *Client) macroDefOperation() {
 	if c.wipMacro == nil {
-		c.error("macroDefOperation: nil wip function")
+		c.error(errorInvalidState, "macroDefOperation: nil wip function")
 	}
 	opcode := c.popUint8()
+	if opcode >= ropCodeCount {
+		c.error(errorUnknownOpcode, "macroDefOperation: invalid render opcode: "+fmt.Sprint(opcode))
+	}
+	c.checkOperandsGiven("macroDefOperation")
+	switch opcode {
+	case ropRepeat, ropIf:
+		c.wipMacro.blocks++
+	case ropEnd:
+		if c.wipMacro.blocks == 0 {
+			c.error(errorInvalidState, "macroDefOperation: ropEnd without an open block")
+		}
+		c.wipMacro.blocks--
+	}
 	c.wipMacro.bytecode.pushUint8(opcode)
+	c.wipMacro.opcode = opcode
+	c.wipMacro.pending = renderOpcodes[opcode].operands
+}
+
+// checkOperandsGiven fails if the last operation of the macro being defined
+// is missing operands.
+func (c *Client) checkOperandsGiven(name string) {
+	if pending := c.wipMacro.pending; len(pending) > 0 {
+		c.error(errorInvalidState, fmt.Sprint(name, ": ", opcodeName(true, c.wipMacro.opcode), " is missing its ", pending[0], " operand"))
+	}
+}
+
+// nextPending returns the type of the operand the next constant or variable
+// of the macro being defined is for, or false if the operation doesn't take
+// more operands.
+func (c *Client) nextPending() (OperandType, bool) {
+	if len(c.wipMacro.pending) == 0 {
+		return 0, false
+	}
+	operandType := c.wipMacro.pending[0]
+	c.wipMacro.pending = c.wipMacro.pending[1:]
+	return operandType, true
 }
 
 func (c *Client) macroDefVar() {
 	if c.wipMacro == nil {
-		c.error("macroDefVar: nil wip function")
+		c.error(errorInvalidState, "macroDefVar: nil wip function")
 	}
-	variableSize := int(c.popUint8())
+	variableType := OperandType(c.popUint8())
+	if !variableType.isVariableType() {
+		c.error(errorOutOfRange, "macroDefVar: invalid variable type: "+fmt.Sprint(uint8(variableType)))
+	}
+	variableSize := variableType.fixedSize(c.header.numberFormat)
+	c.wipMacro.variableTypes = append(c.wipMacro.variableTypes, variableType)
 	c.wipMacro.variableSizes = append(c.wipMacro.variableSizes, variableSize)
 	c.wipMacro.variableStartIndexes = append(c.wipMacro.variableStartIndexes, c.wipMacro.totalVariablesSize)
 	c.wipMacro.totalVariablesSize += variableSize
@@ -366,9 +991,19 @@ func (c *Client) macroDefVar() {
 
 func (c *Client) macroDefUseVar() {
 	if c.wipMacro == nil {
-		c.error("macroDefUseVar: nil wip function")
+		c.error(errorInvalidState, "macroDefUseVar: nil wip function")
+	}
+	variableNumber := c.popVariableNumber()
+	if int(variableNumber) >= len(c.wipMacro.variableSizes) {
+		c.error(errorOutOfRange, "macroDefUseVar: invalid variableNumber: "+fmt.Sprint(variableNumber))
+	}
+	variableType := c.wipMacro.variableTypes[variableNumber]
+	operandType, ok := c.nextPending()
+	if !ok {
+		c.error(errorInvalidState, "macroDefUseVar: variable used past the operands of "+opcodeName(true, c.wipMacro.opcode))
+	} else if operandType != variableType {
+		c.error(errorInvalidState, fmt.Sprint("macroDefUseVar: ", variableType, " variable used for ", operandType, " operand of ", opcodeName(true, c.wipMacro.opcode)))
 	}
-	variableNumber := c.popUint16()
 	variableReference := FunctionVariableReference{
 		variableStartIndex: c.wipMacro.variableStartIndexes[variableNumber],
 		variableNumber:     variableNumber,
@@ -382,14 +1017,31 @@ func (c *Client) macroDefUseVar() {
 
 func (c *Client) macroDefUseConst() {
 	if c.wipMacro == nil {
-		c.error("macroDefUseConst: nil wip function")
+		c.error(errorInvalidState, "macroDefUseConst: nil wip function")
+	}
+	constSize := c.popSize()
+	debugPrint("macroDefUseConst: constSize: ", constSize)
+	constBytes := c.popBytes(constSize)
+	debugPrint("constBytes: ", constBytes)
+	operandType, ok := c.nextPending()
+	if !ok {
+		c.error(errorInvalidState, "macroDefUseConst: constant past the operands of "+opcodeName(true, c.wipMacro.opcode))
 	}
-	constSize := int(c.popUint8())
-	fmt.Println("macroDefUseConst: constSize: ", constSize)
-	for i := 0; i < constSize; i++ {
-		constByte := c.popUint8()
-		fmt.Println("constByte: ", constByte)
-		c.wipMacro.bytecode.pushUint8(constByte)
+	if err := checkMacroConst(operandType, constBytes, c.header.numberFormat); err != nil {
+		c.error(errorInvalidState, "macroDefUseConst: "+opcodeName(true, c.wipMacro.opcode)+": "+err.Error())
+	}
+	c.wipMacro.bytecode.pushBytes(constBytes)
+	if operandType == operandMacro {
+		// the arguments of a macro call are given one by one, so that the
+		// caller can pass on its own variables
+		constBytecode := NewBytecodeFromBytes(constBytes)
+		macroNumber := constBytecode.popMacroNumber()
+		macro, ok := c.macros[macroNumber]
+		if !ok {
+			c.error(errorUnknownMacro, "macroDefUseConst: call of undefined macro: "+fmt.Sprint(macroNumber))
+		}
+		c.wipMacro.pending = macro.variableTypes
+		c.wipMacro.calls = append(c.wipMacro.calls, macroNumber)
 	}
 }
 
@@ -397,19 +1049,57 @@ func (c *Client) nodeCreate() {
 	nodeNumber := c.popNodeNumber()
 	newNode := NewNode()
 	if _, ok := c.nodes[nodeNumber]; ok {
-		c.error("nodeCreate: a node with nodeNumber already exists")
+		c.error(errorDuplicateID, "nodeCreate: a node with nodeNumber already exists: "+fmt.Sprint(nodeNumber))
 	}
 	c.nodes[nodeNumber] = newNode
 	c.root.AddChild(newNode)
+	c.record(func() {
+		delete(c.root.children, newNode)
+		delete(c.nodes, nodeNumber)
+	})
 }
 
 func (c *Client) nodeSetContent() {
 	node := c.popNode()
-	macroBytecode := c.popAndCompileMacro()
-	if node == nil || macroBytecode == nil {
+	macroNumber := c.popMacroNumber()
+	macro, ok := c.macros[macroNumber]
+	if !ok {
+		c.error(errorUnknownMacro, "nodeSetContent: invalid macroNumber: "+fmt.Sprint(macroNumber))
+	}
+	args := c.popBytes(macro.totalVariablesSize)
+	if node == nil {
 		return
 	}
-	node.renderCode = macroBytecode
+	c.recordNode(node)
+	node.content = macro
+	node.contentArgs = append([]byte(nil), args...)
+	node.renderCode = macro.Compile(node.contentArgs)
+}
+
+// nodeSetArgument changes one variable of a node's content, patching its
+// compiled render code instead of compiling the macro again.
+func (c *Client) nodeSetArgument() {
+	node := c.popNode()
+	variableNumber := c.popVariableNumber()
+	value := c.popBytes(c.popSize())
+	macro := node.content
+	if macro == nil {
+		c.error(errorInvalidState, "nodeSetArgument: node content isn't a macro")
+	}
+	if int(variableNumber) >= len(macro.variableSizes) {
+		c.error(errorOutOfRange, "nodeSetArgument: invalid variableNumber: "+fmt.Sprint(variableNumber))
+	}
+	if len(value) != macro.variableSizes[variableNumber] {
+		c.error(errorOutOfRange, fmt.Sprint("nodeSetArgument: ", len(value), " bytes given for a ", macro.variableTypes[variableNumber], " variable"))
+	}
+	c.recordNode(node)
+	start := macro.variableStartIndexes[variableNumber]
+	old := append([]byte(nil), node.contentArgs[start:start+len(value)]...)
+	node.contentArgs = append([]byte(nil), node.contentArgs...)
+	copy(node.contentArgs[start:], value)
+	renderCode := node.renderCode
+	macro.Patch(renderCode, variableNumber, value)
+	c.record(func() { macro.Patch(renderCode, variableNumber, old) })
 }
 
 func (c *Client) nodeSetParent() {
@@ -420,8 +1110,9 @@ func (c *Client) nodeSetParent() {
 	parentNodeNumber := c.popNodeNumber()
 	parentNode, ok := c.nodes[parentNodeNumber]
 	if !ok {
-		c.error("nodeSetParent: invalid parentNodeNumber")
+		c.error(errorUnknownNode, "nodeSetParent: invalid parentNodeNumber: "+fmt.Sprint(parentNodeNumber))
 	}
+	c.recordNode(node)
 	parentNode.AddChild(node)
 }
 
@@ -431,7 +1122,9 @@ func (c *Client) nodeSetPosition() {
 		return
 	}
 	newPosition := c.popVec2()
+	c.recordNode(node)
 	node.position = newPosition
+	node.hasTransform = false
 }
 
 func (c *Client) nodeSetRotation() {
@@ -440,7 +1133,9 @@ func (c *Client) nodeSetRotation() {
 		return
 	}
 	rotation := c.popRotation()
+	c.recordNode(node)
 	node.rotation = rotation
+	node.hasTransform = false
 }
 
 func (c *Client) nodeSetScale() {
@@ -449,13 +1144,38 @@ func (c *Client) nodeSetScale() {
 		return
 	}
 	scale := c.popScale()
+	c.recordNode(node)
 	node.scale = scale
+	node.hasTransform = false
+}
+
+// nodeSetTransform replaces the node's position, rotation and scale with an
+// affine matrix until one of them is set again.
+func (c *Client) nodeSetTransform() {
+	node := c.popNode()
+	if node == nil {
+		return
+	}
+	transform := c.popAffine()
+	c.recordNode(node)
+	node.transform = transform
+	node.hasTransform = true
+}
+
+func (c *Client) nodeSetPivot() {
+	node := c.popNode()
+	if node == nil {
+		return
+	}
+	pivot := c.popVec2()
+	c.recordNode(node)
+	node.pivot = pivot
 }
 
 func (c *Client) anchorCreate() {
 	anchorNumber := c.popAnchorNumber()
 	if _, ok := c.anchors[anchorNumber]; ok {
-		c.error("nodeCreate: a node with nodeNumber already exists")
+		c.error(errorDuplicateID, "anchorCreate: an anchor with anchorNumber already exists: "+fmt.Sprint(anchorNumber))
 	}
 	node := c.popNode()
 	position := c.popVec2()
@@ -463,6 +1183,7 @@ func (c *Client) anchorCreate() {
 		node:     node,
 		position: position,
 	}
+	c.record(func() { delete(c.anchors, anchorNumber) })
 }
 
 // ------------------------- RENDER OPERATIONS --------------------------------
@@ -484,6 +1205,9 @@ func (c *Client) beginPath(n *Node) {
 	// c.nvgCtx.ClosePath()
 	// c.nvgCtx.SetFillColor(nanovgo.RGB(255, 255, 255))
 	// c.nvgCtx.Fill()
+	c.pathPoint = Vec2{}
+	c.subpathStart = Vec2{}
+	c.pathStarted = false
 	c.nvgCtx.BeginPath()
 }
 
@@ -498,23 +1222,58 @@ func (c *Client) fill(n *Node) {
 	c.nvgCtx.Fill()
 }
 
-func (c *Client) moveTo(n *Node) {
-	vec2 := c.popVec2()
+func (c *Client) pathMoveTo(n *Node, vec2 Vec2) {
+	c.pathPoint = vec2
+	c.subpathStart = vec2
+	c.pathStarted = true
 	point := n.TransformPoint(vec2)
 	fmt.Println("moveTo: vec2: ", vec2, " point: ", point)
-	c.nvgCtx.MoveTo(float32(point.X), float32(point.Y))
+	c.path.MoveTo(float32(point.X), float32(point.Y))
 }
 
-func (c *Client) lineTo(n *Node) {
-	vec2 := c.popVec2()
+func (c *Client) pathLineTo(n *Node, vec2 Vec2) {
+	c.pathPoint = vec2
 	point := n.TransformPoint(vec2)
 	fmt.Println("lineTo: vec2: ", vec2, " point: ", point)
-	c.nvgCtx.LineTo(float32(point.X), float32(point.Y))
+	c.path.LineTo(float32(point.X), float32(point.Y))
+}
+
+func (c *Client) moveTo(n *Node) {
+	c.pathMoveTo(n, c.popVec2())
+}
+
+func (c *Client) lineTo(n *Node) {
+	c.pathLineTo(n, c.popVec2())
+}
+
+func (c *Client) moveToRelative(n *Node) {
+	c.pathMoveTo(n, c.pathPoint.Add(c.popVec2()))
+}
+
+func (c *Client) lineToRelative(n *Node) {
+	c.pathLineTo(n, c.pathPoint.Add(c.popVec2()))
+}
+
+func (c *Client) moveToDelta8(n *Node) {
+	c.pathMoveTo(n, c.pathPoint.Add(c.popDelta8()))
+}
+
+func (c *Client) lineToDelta8(n *Node) {
+	c.pathLineTo(n, c.pathPoint.Add(c.popDelta8()))
+}
+
+func (c *Client) moveToDelta16(n *Node) {
+	c.pathMoveTo(n, c.pathPoint.Add(c.popDelta16()))
+}
+
+func (c *Client) lineToDelta16(n *Node) {
+	c.pathLineTo(n, c.pathPoint.Add(c.popDelta16()))
 }
 
 func (c *Client) closePath(n *Node) {
 	fmt.Println("closePath")
-	c.nvgCtx.ClosePath()
+	c.pathPoint = c.subpathStart
+	c.path.ClosePath()
 }
 
 // func (c *Client) rectangle(n *Node) {
@@ -528,7 +1287,27 @@ func (c *Client) closePath(n *Node) {
 // 	c.nvgCtx.ClosePath()
 // }
 
+// useAnchor draws a line to an anchor, a point in the space of another node, so
+// paths can connect nodes. The anchor node's transform is taken as of this
+// render, whether or not it has been drawn yet.
+func (c *Client) useAnchor(n *Node) {
+	anchorNumber := c.popAnchorNumber()
+	anchor, ok := c.anchors[anchorNumber]
+	if !ok {
+		c.error(errorUnknownAnchor, "useAnchor: invalid anchorNumber: "+fmt.Sprint(anchorNumber))
+	}
+	point := anchor.node.GlobalMatrix().MultiplyVec2(anchor.position)
+	if globalToLocal, ok := n.localToGlobal.Inverse(); ok {
+		c.pathPoint = globalToLocal.MultiplyVec2(point)
+	}
+	c.path.LineTo(float32(point.X), float32(point.Y))
+}
+
 func (c *Client) macroCall(n *Node) {
 	macroBytecode := c.popAndCompileMacro()
+	if len(c.stack) >= maxMacroCallDepth {
+		c.error(errorInvalidState, "macroCall: macro calls nested deeper than "+fmt.Sprint(maxMacroCallDepth))
+	}
 	c.pushState(macroBytecode)
+	c.renderMacro(n)
 }
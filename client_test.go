@@ -0,0 +1,218 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/shibukawa/nanovgo"
+)
+
+func TestNodesShareMacroWithOwnArguments(t *testing.T) {
+	server, client := newTestSession(t)
+	colors := []nanovgo.Color{colorRed, colorGreen, colorBlue, colorBlack}
+	nodes := make([]NodeNumber, len(colors))
+	sendFrame(t, server, client, func() {
+		macroNumber := server.macroStart()
+		colorVar := server.macroVar(operandRgba)
+		pointVar := server.macroVar(operandVec2)
+		server.macroBeginPath()
+		server.macroOperation(ropMoveTo)
+		server.macroUseVar(pointVar)
+		server.macroOperation(ropSetFillColor)
+		server.macroUseVar(colorVar)
+		server.macroEnd()
+		for i, color := range colors {
+			nodes[i] = server.nodeCreate()
+			server.nodeSetContent(nodes[i], macroNumber, color, Vec2{float64(i), 10})
+		}
+	})
+
+	var filled []nanovgo.Color
+	client.renderOperations[ropSetFillColor] = func(n *Node) { filled = append(filled, client.popRgba()) }
+	for i, nodeNumber := range nodes {
+		filled = nil
+		points := renderTestNode(t, client, nodeNumber, ropMoveTo)
+		if len(filled) != 1 || filled[0] != colors[i] {
+			t.Fatalf("node %d filled with %v, want %v", i, filled, colors[i])
+		}
+		if !samePoints(points, []Vec2{{float64(i), 10}}) {
+			t.Fatalf("node %d moved to %v, want {%d 10}", i, points, i)
+		}
+	}
+	for i := 1; i < len(nodes); i++ {
+		if client.nodes[nodes[i]].renderCode == client.nodes[nodes[0]].renderCode {
+			t.Fatalf("nodes 0 and %d share their render code", i)
+		}
+	}
+}
+
+func TestForwardedArgumentsThroughNestedMacros(t *testing.T) {
+	server, client := newTestSession(t)
+	var node NodeNumber
+	sendFrame(t, server, client, func() {
+		fill := server.macroStart()
+		colorVar := server.macroVar(operandRgba)
+		server.macroOperation(ropSetFillColor)
+		server.macroUseVar(colorVar)
+		server.macroEnd()
+
+		move := server.macroStart()
+		colorVar = server.macroVar(operandRgba)
+		pointVar := server.macroVar(operandVec2)
+		server.macroOperation(ropMoveTo)
+		server.macroUseVar(pointVar)
+		server.macroMacroCall(fill, forwardVariable(colorVar))
+		server.macroEnd()
+
+		shape := server.macroStart()
+		colorVar = server.macroVar(operandRgba)
+		server.macroBeginPath()
+		server.macroMacroCall(move, forwardVariable(colorVar), Vec2{7, 8})
+		server.macroMacroCall(fill, colorGreen)
+		server.macroEnd()
+
+		outer := server.macroStart()
+		server.macroMacroCall(shape, colorBlue)
+		server.macroEnd()
+
+		node = server.nodeCreate()
+		server.nodeSetContent(node, outer)
+	})
+	var filled []nanovgo.Color
+	client.renderOperations[ropSetFillColor] = func(n *Node) { filled = append(filled, client.popRgba()) }
+	points := renderTestNode(t, client, node, ropMoveTo)
+	if len(filled) != 2 || filled[0] != colorBlue || filled[1] != colorGreen {
+		t.Fatalf("filled with %v, want blue then green", filled)
+	}
+	if !samePoints(points, []Vec2{{7, 8}}) {
+		t.Fatalf("moved to %v, want {7 8}", points)
+	}
+	if len(client.stack) != 0 {
+		t.Fatalf("%d states left on the stack", len(client.stack))
+	}
+}
+
+func TestMacroCallDepthLimit(t *testing.T) {
+	server, client := newTestSession(t)
+	var node NodeNumber
+	sendFrame(t, server, client, func() {
+		recursive := server.macroStart()
+		server.macroEnd()
+		server.macroRedefine(recursive)
+		server.macroBeginPath()
+		server.macroMacroCall(recursive)
+		server.macroEnd()
+		node = server.nodeCreate()
+		server.nodeSetContent(node, recursive)
+	})
+	calls := 0
+	client.renderOperations[ropBeginPath] = func(n *Node) { calls++ }
+	err := client.renderContent(client.nodes[node])
+	if decodeError, ok := err.(*DecodeError); !ok || decodeError.kind != errorInvalidState || !decodeError.render {
+		t.Fatalf("renderContent returned %v, want an errorInvalidState render error", err)
+	}
+	// the node's content and the calls nested in it
+	if calls != 1+maxMacroCallDepth {
+		t.Fatalf("macro ran %d times, want %d", calls, 1+maxMacroCallDepth)
+	}
+	if len(client.stack) != 0 {
+		t.Fatalf("%d states left on the stack", len(client.stack))
+	}
+	// the client still renders the rest of the scene
+	client.renderOperations[ropBeginPath] = func(n *Node) {}
+	if err := client.renderContent(client.nodes[testNode1]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNodePivot(t *testing.T) {
+	server, client := newTestSession(t)
+	var node NodeNumber
+	sendFrame(t, server, client, func() {
+		node = server.nodeCreate()
+		server.nodeSetPivot(node, Vec2{50, 50})
+		server.nodeSetPosition(node, Vec2{200, 100})
+		server.nodeSetRotation(node, math.Pi/2)
+		server.nodeSetScale(node, Vec2{2, 3})
+	})
+	global := client.nodes[node].GlobalMatrix()
+	// the pivot is placed at the position, the node turns and scales around it
+	for _, test := range []struct{ local, want Vec2 }{
+		{Vec2{50, 50}, Vec2{200, 100}},
+		{Vec2{51, 50}, Vec2{200, 102}},
+		{Vec2{50, 51}, Vec2{197, 100}},
+	} {
+		if point := global.MultiplyVec2(test.local); !closePoints(point, test.want) {
+			t.Fatalf("%v placed at %v, want %v", test.local, point, test.want)
+		}
+	}
+
+	// a transform replaces position, rotation and scale, the pivot still applies
+	sendFrame(t, server, client, func() {
+		server.nodeSetTransform(node, Matrix33{m00: 1, m01: 1, m02: 10, m10: 0, m11: 2, m12: 20, m22: 1})
+	})
+	global = client.nodes[node].GlobalMatrix()
+	if point := global.MultiplyVec2(Vec2{51, 52}); !closePoints(point, Vec2{13, 24}) {
+		t.Fatalf("transformed point at %v, want {13 24}", point)
+	}
+}
+
+func TestOperandsCheckedAgainstOpcodeTable(t *testing.T) {
+	server, client := newTestSession(t)
+	// an operation that reads fewer operand bytes than its description
+	client.updateOperations[uopNodeSetPosition] = func() { client.popNode() }
+	if err := server.build(func() { server.nodeSetPosition(testNode1, Vec2{1, 2}) }); err != nil {
+		t.Fatal(err)
+	}
+	_, err := client.Update(server.frame())
+	if !isDecodeErrorKind(err, errorInvalidState) {
+		t.Fatalf("Update returned %v, want an errorInvalidState DecodeError", err)
+	}
+}
+
+func TestNodeSetArgument(t *testing.T) {
+	server, client := newTestSession(t)
+	var node NodeNumber
+	var colorVar, pointVar uint16
+	sendFrame(t, server, client, func() {
+		macroNumber := server.macroStart()
+		colorVar = server.macroVar(operandRgba)
+		pointVar = server.macroVar(operandVec2)
+		server.macroBeginPath()
+		server.macroOperation(ropMoveTo)
+		server.macroUseVar(pointVar)
+		server.macroOperation(ropSetFillColor)
+		server.macroUseVar(colorVar)
+		server.macroEnd()
+		node = server.nodeCreate()
+		server.nodeSetContent(node, macroNumber, colorRed, Vec2{1, 2})
+	})
+	var filled []nanovgo.Color
+	client.renderOperations[ropSetFillColor] = func(n *Node) { filled = append(filled, client.popRgba()) }
+	render := func(color nanovgo.Color, point Vec2) {
+		t.Helper()
+		filled = nil
+		points := renderTestNode(t, client, node, ropMoveTo)
+		if len(filled) != 1 || filled[0] != color || !samePoints(points, []Vec2{point}) {
+			t.Fatalf("filled with %v at %v, want %v at %v", filled, points, color, point)
+		}
+	}
+
+	sendFrame(t, server, client, func() { server.nodeSetArgument(node, pointVar, Vec2{30, 40}) })
+	render(colorRed, Vec2{30, 40})
+	sendFrame(t, server, client, func() { server.nodeSetArgument(node, colorVar, colorBlue) })
+	render(colorBlue, Vec2{30, 40})
+
+	err := server.build(func() { server.nodeSetArgument(node, colorVar, Vec2{1, 2}) })
+	if _, ok := err.(*EncodeError); !ok {
+		t.Fatalf("setting a vec2 for a color returned %v, want an EncodeError", err)
+	}
+	// a stream written without the server's checks
+	if err := server.build(func() { server.update(uopNodeSetArgument, node, colorVar, []byte{1, 2}) }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Update(server.frame()); !isDecodeErrorKind(err, errorOutOfRange) {
+		t.Fatalf("Update returned %v, want an errorOutOfRange DecodeError", err)
+	}
+	render(colorBlue, Vec2{30, 40})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// With featureCompression every frame payload starts with a flags byte. A
+// compressed payload is deflated with a preset dictionary both sides build the
+// same way: the macro definitions sent so far and, for delta frames, the
+// operations of the previous frame. Update frames mostly repeat the previous
+// one with different values, so a delta frame is little more than the values.
+// A frame without frameDeltaDictionary is a key frame: both sides start over
+// with an empty dictionary. A client that lost a frame can't decode the delta
+// frames after it, since its dictionary differs from the server's. The server
+// sends a key frame every compressionKeyInterval frames, and the next frame
+// after RequestKeyFrame, so the client recovers.
+
+const (
+	frameCompressed      = 1 << iota // the rest of the payload is deflated
+	frameDeltaDictionary             // the dictionary ends with the previous frame
+)
+
+const compressionKeyInterval = 30
+
+// maxDictionarySize is the deflate window, older dictionary bytes can't be
+// referenced.
+const maxDictionarySize = 32 << 10
+
+type compressionDictionary struct {
+	macros           []byte   // macro definitions, the newest maxDictionarySize bytes
+	previous         []byte   // operations of the last frame
+	previousSequence uint32   // sequence of the last frame, valid if previous isn't nil
+	definitions      [][2]int // macro definitions in the current frame, end -1 if open
+	keyRequested     bool     // the next frame is a key frame, on the server
+	lost             bool     // a frame wasn't applied, on the client: only a key frame can be decoded
+}
+
+// reset empties the dictionary for a key frame.
+func (d *compressionDictionary) reset() {
+	d.macros, d.previous = nil, nil
+	d.lost = false
+}
+
+// deltaPossible reports whether the frame with the given sequence can be a
+// delta frame if no key frame was requested.
+func (d *compressionDictionary) deltaPossible(sequence uint32) bool {
+	return d.previous != nil && d.previousSequence == sequence-1 && sequence%compressionKeyInterval != 0
+}
+
+func (d *compressionDictionary) startDefinition(offset int) {
+	d.definitions = append(d.definitions, [2]int{offset, -1})
+}
+
+// endDefinition closes the open definition, or one started in an earlier frame.
+func (d *compressionDictionary) endDefinition(offset int) {
+	if last := len(d.definitions) - 1; last >= 0 && d.definitions[last][1] < 0 {
+		d.definitions[last][1] = offset
+		return
+	}
+	d.definitions = append(d.definitions, [2]int{0, offset})
+}
+
+// commit adds the operations of a frame that was sent or applied.
+func (d *compressionDictionary) commit(sequence uint32, operations []byte) {
+	for _, definition := range d.definitions {
+		end := definition[1]
+		if end < 0 {
+			end = len(operations)
+		}
+		d.macros = append(d.macros, operations[definition[0]:end]...)
+	}
+	if len(d.macros) > maxDictionarySize {
+		d.macros = append([]byte{}, d.macros[len(d.macros)-maxDictionarySize:]...)
+	}
+	d.definitions = nil
+	d.previous = append(d.previous[:0], operations...)
+	d.previousSequence = sequence
+}
+
+// dictionary returns the preset dictionary for a frame.
+func (d *compressionDictionary) dictionary(delta bool) []byte {
+	dictionary := d.macros
+	if delta {
+		dictionary = append(append([]byte{}, d.macros...), d.previous...)
+	}
+	if len(dictionary) > maxDictionarySize {
+		dictionary = dictionary[len(dictionary)-maxDictionarySize:]
+	}
+	return dictionary
+}
+
+// compress returns the payload of a frame with the given operations, stored as
+// is if deflate doesn't make it smaller.
+func (d *compressionDictionary) compress(sequence uint32, operations []byte) []byte {
+	flags := uint8(0)
+	delta := !d.keyRequested && d.deltaPossible(sequence)
+	if delta {
+		flags |= frameDeltaDictionary
+	} else {
+		d.reset()
+		d.keyRequested = false
+	}
+	compressed := bytes.NewBuffer([]byte{flags | frameCompressed})
+	w, _ := flate.NewWriterDict(compressed, flate.BestCompression, d.dictionary(delta))
+	w.Write(operations)
+	w.Close()
+	if compressed.Len() > len(operations) {
+		return append([]byte{flags}, operations...)
+	}
+	return compressed.Bytes()
+}
+
+var errDecompressedFrameSize = errors.New("decompressed frame larger than maxFrameSize")
+
+// decompress reads the flags byte of a payload and returns a reader of the
+// operations.
+func (d *compressionDictionary) decompress(sequence uint32, payload io.Reader) (io.Reader, error) {
+	var flags [1]byte
+	if _, err := io.ReadFull(payload, flags[:]); err != nil {
+		return nil, err
+	}
+	// a stored delta frame needs the previous frame too, the dictionary of
+	// the frames after it would differ from the server's otherwise
+	delta := flags[0]&frameDeltaDictionary != 0
+	if !delta {
+		d.reset()
+	} else if d.lost || d.previous == nil || d.previousSequence != sequence-1 {
+		return nil, fmt.Errorf("frame %d is compressed against frame %d, which wasn't applied", sequence, sequence-1)
+	}
+	if flags[0]&frameCompressed == 0 {
+		return payload, nil
+	}
+	return flate.NewReaderDict(payload, d.dictionary(delta)), nil
+}
+
+// decompressBytes returns the operations of an in memory payload.
+func (d *compressionDictionary) decompressBytes(sequence uint32, payload []byte) ([]byte, error) {
+	operations, err := d.decompress(sequence, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > 0 && payload[0]&frameCompressed == 0 {
+		return payload[1:], nil
+	}
+	return ioutil.ReadAll(&sizeLimitReader{reader: operations, remaining: maxFrameSize})
+}
+
+// sizeLimitReader fails reads past a maximum size instead of ending the
+// stream there, so an oversized frame isn't applied cut short.
+type sizeLimitReader struct {
+	reader    io.Reader
+	remaining int
+}
+
+func (r *sizeLimitReader) Read(bytes []byte) (int, error) {
+	if len(bytes) > r.remaining+1 {
+		bytes = bytes[:r.remaining+1]
+	}
+	n, err := r.reader.Read(bytes)
+	r.remaining -= n
+	if r.remaining < 0 {
+		return 0, errDecompressedFrameSize
+	}
+	return n, err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// updateFrame writes the next update frame of the test scene.
+func updateFrame(t *testing.T, server *Server) []byte {
+	t.Helper()
+	frame, err := server.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func newCompressedSession(t *testing.T) (*Server, *Client) {
+	t.Helper()
+	server, client := connectTestClient(t, featureCompression)
+	frame, err := server.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Update(frame); err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+func TestRequestedKeyFrameAfterLostFrame(t *testing.T) {
+	server, client := newCompressedSession(t)
+	for i := 0; i < 3; i++ {
+		if _, err := client.Update(updateFrame(t, server)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	updateFrame(t, server) // lost
+	for i := 0; i < 2; i++ {
+		if _, err := client.Update(updateFrame(t, server)); err == nil {
+			t.Fatal("delta frame after a lost frame was applied")
+		}
+		if !client.KeyFrameNeeded() {
+			t.Fatal("client doesn't need a key frame after a lost frame")
+		}
+	}
+	server.RequestKeyFrame()
+	for i := 0; i < 5; i++ {
+		if _, err := client.Update(updateFrame(t, server)); err != nil {
+			t.Fatalf("frame %d after the key frame: %v", i, err)
+		}
+	}
+	if client.KeyFrameNeeded() {
+		t.Fatal("client still needs a key frame")
+	}
+	if client.nextSequence != server.sequence {
+		t.Fatalf("next sequence %d, want %d", client.nextSequence, server.sequence)
+	}
+}
+
+func TestKeyFrameRecoversLostMacroDefinition(t *testing.T) {
+	server, client := newCompressedSession(t)
+	if err := server.build(func() {
+		macroNumber := server.macroStart()
+		server.macroBeginPath()
+		server.macroEnd()
+		server.nodeSetContent(server.nodeCreate(), macroNumber)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	server.frame() // lost
+	if bytes.Equal(client.dictionary.macros, server.dictionary.macros) {
+		t.Fatal("the lost frame didn't add to the server's dictionary")
+	}
+	// without a way to ask for one, the client waits for the periodic key frame
+	for server.sequence%compressionKeyInterval != 0 {
+		if _, err := client.Update(updateFrame(t, server)); err == nil {
+			t.Fatalf("delta frame %d after a lost frame was applied", server.sequence-1)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := client.Update(updateFrame(t, server)); err != nil {
+			t.Fatalf("frame %d after the key frame: %v", i, err)
+		}
+	}
+	if !bytes.Equal(client.dictionary.macros, server.dictionary.macros) || !bytes.Equal(client.dictionary.previous, server.dictionary.previous) {
+		t.Fatal("client and server dictionaries differ after the key frame")
+	}
+}
+
+func TestAssembleRequestedKeyFrame(t *testing.T) {
+	server, _ := connectTestClient(t, featureCompression)
+	stream := bytes.NewBuffer(EncodeStreamHeader(server.header))
+	if err := server.WriteInit(stream); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if i == 3 {
+			server.RequestKeyFrame()
+		}
+		if err := server.WriteUpdate(stream); err != nil {
+			t.Fatal(err)
+		}
+	}
+	text, err := Disassemble(stream.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keyFrames []string
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, ".frame ") && strings.HasSuffix(line, " key") {
+			keyFrames = append(keyFrames, line)
+		}
+	}
+	if len(keyFrames) != 1 || !strings.HasPrefix(keyFrames[0], ".frame 4 ") {
+		t.Fatalf("key frames marked %q, want frame 4", keyFrames)
+	}
+	assembled, err := Assemble(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(assembled, stream.Bytes()) {
+		t.Fatal("assembled stream differs from the recorded one")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import "fmt"
+
+// Render code can repeat and skip runs of operations. ropRepeat runs the
+// operations up to the matching ropEnd a given number of times, ropPushIndex
+// pushes the number of the current repetition onto the value stack. ropIf pops
+// a value from the value stack and runs the operations up to the matching
+// ropEnd only if it isn't zero. Blocks nest and don't reach past the end of a
+// macro.
+
+// maxRenderSteps bounds the render operations a Render runs, so a stream with
+// huge loops can't hang the viewer.
+const maxRenderSteps = 1 << 20
+
+type block struct {
+	bytecode *Bytecode // render code the block is in
+	start    int       // offset of the first operation in the block
+	index    int
+	count    int // repetitions, 0 for an if block
+}
+
+// blockOpcode reports whether the opcode works on the blocks of the render
+// code it is in. ropApply runs its operation on a bytecode of its own, so it
+// can't apply these.
+func blockOpcode(opcode uint8) bool {
+	switch opcode {
+	case ropRepeat, ropIf, ropEnd, ropPushIndex:
+		return true
+	}
+	return false
+}
+
+func (c *Client) repeat(n *Node) {
+	count := int(c.popUint16())
+	if count == 0 {
+		c.skipBlock()
+		return
+	}
+	c.blocks = append(c.blocks, block{bytecode: c.Bytecode, start: c.i, count: count})
+}
+
+func (c *Client) ifNonZero(n *Node) {
+	if c.popValues(1)[0] == 0 {
+		c.skipBlock()
+		return
+	}
+	c.blocks = append(c.blocks, block{bytecode: c.Bytecode, start: c.i})
+}
+
+func (c *Client) end(n *Node) {
+	last := len(c.blocks) - 1
+	if last < 0 || c.blocks[last].bytecode != c.Bytecode {
+		c.error(errorInvalidState, "end: no open block")
+	}
+	current := &c.blocks[last]
+	current.index++
+	if current.index < current.count {
+		c.i = current.start
+		return
+	}
+	c.blocks = c.blocks[:last]
+}
+
+func (c *Client) pushIndex(n *Node) {
+	for i := len(c.blocks) - 1; i >= 0 && c.blocks[i].bytecode == c.Bytecode; i-- {
+		if c.blocks[i].count > 0 {
+			c.pushValues(float64(c.blocks[i].index))
+			return
+		}
+	}
+	c.error(errorInvalidState, "pushIndex: not in a repeat block")
+}
+
+// skipBlock reads past the operations up to the ropEnd matching a block that
+// isn't run.
+func (c *Client) skipBlock() {
+	macroArgsSize := func(macroNumber MacroNumber) int {
+		macro, ok := c.macros[macroNumber]
+		if !ok {
+			c.error(errorUnknownMacro, "skipBlock: invalid macroNumber: "+fmt.Sprint(macroNumber))
+		}
+		return macro.totalVariablesSize
+	}
+	for depth := 1; depth > 0; {
+		if !c.more() {
+			c.error(errorInvalidState, "skipBlock: render code ends inside a block")
+		}
+		opcode := c.popOpcode()
+		if opcode >= ropCodeCount {
+			c.error(errorUnknownOpcode, "skipBlock: invalid render opcode: "+fmt.Sprint(opcode))
+		}
+		switch opcode {
+		case ropRepeat, ropIf:
+			depth++
+		case ropEnd:
+			depth--
+		}
+		c.skipOperands(renderOpcodes[opcode].operands, macroArgsSize)
+	}
+}
+
+// macroRepeat starts a block of the macro being defined that is run count
+// times.
+func (s *Server) macroRepeat(count uint16) {
+	s.macroOperation(ropRepeat)
+	s.macroUseConstUint16(count)
+}
+
+// macroRepeatVar starts a block run as many times as a uint16 variable says.
+func (s *Server) macroRepeatVar(variableNumber uint16) {
+	s.macroOperation(ropRepeat)
+	s.macroUseVar(variableNumber)
+}
+
+// macroIf starts a block that is run if the value it pops isn't zero.
+func (s *Server) macroIf() {
+	s.macroOperation(ropIf)
+}
+
+func (s *Server) macroEndBlock() {
+	s.macroOperation(ropEnd)
+}
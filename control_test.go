@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestApplyRejectsBlockOpcodes(t *testing.T) {
+	for _, opcode := range []uint8{ropRepeat, ropIf, ropEnd, ropPushIndex} {
+		server, client := newTestSession(t)
+		err := server.build(func() {
+			server.macroStart()
+			server.macroApply(opcode)
+			server.macroEnd()
+		})
+		if _, ok := err.(*EncodeError); !ok {
+			t.Fatalf("%s: build returned %v, want an EncodeError", renderOpcodes[opcode].name, err)
+		}
+
+		// a stream written without the server's checks
+		if err := server.build(func() {
+			server.startDefinition(server.newMacroNumber())
+			server.update(uopMacroOperation, uint8(ropApply))
+			server.update(uopMacroUseConst, []byte{opcode})
+			server.update(uopMacroEnd)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.Update(server.frame())
+		if decodeError, ok := err.(*DecodeError); !ok || decodeError.kind != errorInvalidState {
+			t.Fatalf("%s: Update returned %v, want an errorInvalidState DecodeError", renderOpcodes[opcode].name, err)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Curves and shapes add to the path in node coordinates like ropLineTo. An
+// affine transform maps a Bézier curve to the Bézier curve of the transformed
+// control points, so curves are drawn as cubic Béziers transformed point by
+// point: quadratic curves are raised to cubic, and arcs, ellipses and rounded
+// corners are split into Béziers of at most a quarter turn before they are
+// transformed, which keeps them exact under rotation and non-uniform scale.
+//
+// Angles are in radians from the x axis towards the y axis, a positive sweep
+// turns the same way. ropArc connects its start to the current point with a
+// line, or starts a subpath if there is none. ropEllipse, ropRect and
+// ropRoundedRect are closed subpaths of their own.
+
+// arcTolerance is the radius and distance below which arcs become lines.
+const arcTolerance = 0.01
+
+func ellipsePoint(center Vec2, radii Vec2, angle float64) Vec2 {
+	return Vec2{center.X + radii.X*math.Cos(angle), center.Y + radii.Y*math.Sin(angle)}
+}
+
+// ellipseTangent returns the derivative of ellipsePoint by the angle.
+func ellipseTangent(radii Vec2, angle float64) Vec2 {
+	return Vec2{-radii.X * math.Sin(angle), radii.Y * math.Cos(angle)}
+}
+
+// clampSweep limits an arc to a full turn either way.
+func clampSweep(sweep float64) float64 {
+	return math.Max(-2*math.Pi, math.Min(2*math.Pi, sweep))
+}
+
+// arcToArc returns the arc of the given radius that is tangent to the lines
+// from p0 to p1 and from p1 to p2, as nanovgo's ArcTo draws it. ok is false if
+// the corner is too flat or small for an arc and a line to p1 stands in.
+func arcToArc(p0, p1, p2 Vec2, radius float64) (center Vec2, start, sweep float64, ok bool) {
+	d0, d1 := p0.Subtract(p1), p2.Subtract(p1)
+	length0, length1 := math.Hypot(d0.X, d0.Y), math.Hypot(d1.X, d1.Y)
+	if !(radius >= arcTolerance) || length0 < arcTolerance || length1 < arcTolerance {
+		return Vec2{}, 0, 0, false
+	}
+	d0, d1 = d0.DivideFloat(length0), d1.DivideFloat(length1)
+	angle := math.Acos(math.Max(-1, math.Min(1, d0.X*d1.X+d0.Y*d1.Y)))
+	d := radius / math.Tan(angle/2)
+	if !(d <= 10000) {
+		return Vec2{}, 0, 0, false
+	}
+	var end float64
+	if d1.X*d0.Y-d0.X*d1.Y > 0 {
+		center = Vec2{p1.X + d0.X*d + d0.Y*radius, p1.Y + d0.Y*d - d0.X*radius}
+		start, end = math.Atan2(d0.X, -d0.Y), math.Atan2(-d1.X, d1.Y)
+		for sweep = end - start; sweep < 0; sweep += 2 * math.Pi {
+		}
+	} else {
+		center = Vec2{p1.X + d0.X*d - d0.Y*radius, p1.Y + d0.Y*d + d0.X*radius}
+		start, end = math.Atan2(-d0.X, d0.Y), math.Atan2(d1.X, -d1.Y)
+		for sweep = end - start; sweep > 0; sweep -= 2 * math.Pi {
+		}
+	}
+	return center, start, sweep, true
+}
+
+// roundedRectRadii returns the corner radii of a rounded rectangle, limited
+// to half its sides and signed like them.
+func roundedRectRadii(size Vec2, radius float64) Vec2 {
+	if !(radius > 0) {
+		return Vec2{}
+	}
+	return Vec2{
+		math.Copysign(math.Min(radius, math.Abs(size.X)/2), size.X),
+		math.Copysign(math.Min(radius, math.Abs(size.Y)/2), size.Y),
+	}
+}
+
+func (c *Client) pathBezierTo(n *Node, control1 Vec2, control2 Vec2, vec2 Vec2) {
+	c.pathPoint = vec2
+	points := n.TransformPoints([]Vec2{control1, control2, vec2})
+	c.path.BezierTo(
+		float32(points[0].X), float32(points[0].Y),
+		float32(points[1].X), float32(points[1].Y),
+		float32(points[2].X), float32(points[2].Y))
+}
+
+// pathArc adds an elliptical arc, connected to the current point.
+func (c *Client) pathArc(n *Node, center Vec2, radii Vec2, start float64, sweep float64) {
+	if c.pathStarted {
+		c.pathLineTo(n, ellipsePoint(center, radii, start))
+	} else {
+		c.pathMoveTo(n, ellipsePoint(center, radii, start))
+	}
+	c.pathArcSegments(n, center, radii, start, sweep)
+}
+
+// pathArcSegments adds an elliptical arc from the current point, which is its
+// start, as Béziers of at most a quarter turn.
+func (c *Client) pathArcSegments(n *Node, center Vec2, radii Vec2, start float64, sweep float64) {
+	segments := int(math.Ceil(math.Abs(sweep)/(math.Pi/2) - 1e-9))
+	for i := 0; i < segments; i++ {
+		angle0 := start + sweep*float64(i)/float64(segments)
+		angle1 := start + sweep*float64(i+1)/float64(segments)
+		if i == segments-1 {
+			angle1 = start + sweep
+		}
+		kappa := 4.0 / 3 * math.Tan((angle1-angle0)/4)
+		end := ellipsePoint(center, radii, angle1)
+		c.pathBezierTo(n,
+			c.pathPoint.Add(ellipseTangent(radii, angle0).MultiplyFloat(kappa)),
+			end.Subtract(ellipseTangent(radii, angle1).MultiplyFloat(kappa)),
+			end)
+	}
+}
+
+func (c *Client) bezierTo(n *Node) {
+	control1 := c.popVec2()
+	control2 := c.popVec2()
+	c.pathBezierTo(n, control1, control2, c.popVec2())
+}
+
+// quadTo adds a quadratic curve as the cubic curve tracing the same points.
+func (c *Client) quadTo(n *Node) {
+	control := c.popVec2()
+	vec2 := c.popVec2()
+	c.pathBezierTo(n,
+		c.pathPoint.Add(control.Subtract(c.pathPoint).MultiplyFloat(2.0/3)),
+		vec2.Add(control.Subtract(vec2).MultiplyFloat(2.0/3)),
+		vec2)
+}
+
+func (c *Client) arcTo(n *Node) {
+	point1 := c.popVec2()
+	point2 := c.popVec2()
+	radius := c.popFloat64()
+	center, start, sweep, ok := arcToArc(c.pathPoint, point1, point2, radius)
+	if !ok {
+		c.pathLineTo(n, point1)
+		return
+	}
+	c.pathArc(n, center, Vec2{radius, radius}, start, sweep)
+}
+
+func (c *Client) arc(n *Node) {
+	center := c.popVec2()
+	radius := c.popFloat64()
+	start := c.popFloat64()
+	sweep := c.popFloat64()
+	if math.IsNaN(sweep) || math.IsInf(start, 0) || math.IsNaN(start) {
+		c.error(errorOutOfRange, fmt.Sprint("arc: invalid angles ", start, " ", sweep))
+	}
+	c.pathArc(n, center, Vec2{radius, radius}, start, clampSweep(sweep))
+}
+
+func (c *Client) ellipse(n *Node) {
+	center := c.popVec2()
+	radii := c.popVec2()
+	c.pathMoveTo(n, ellipsePoint(center, radii, math.Pi))
+	c.pathArcSegments(n, center, radii, math.Pi, -2*math.Pi)
+	c.closePath(n)
+}
+
+func (c *Client) pathRect(n *Node, position Vec2, size Vec2) {
+	c.pathMoveTo(n, position)
+	c.pathLineTo(n, Vec2{position.X, position.Y + size.Y})
+	c.pathLineTo(n, position.Add(size))
+	c.pathLineTo(n, Vec2{position.X + size.X, position.Y})
+	c.closePath(n)
+}
+
+func (c *Client) rect(n *Node) {
+	position := c.popVec2()
+	c.pathRect(n, position, c.popVec2())
+}
+
+func (c *Client) roundedRect(n *Node) {
+	position := c.popVec2()
+	size := c.popVec2()
+	radii := roundedRectRadii(size, c.popFloat64())
+	if radii == (Vec2{}) {
+		c.pathRect(n, position, size)
+		return
+	}
+	x, y, w, h := position.X, position.Y, size.X, size.Y
+	c.pathMoveTo(n, Vec2{x, y + radii.Y})
+	c.pathLineTo(n, Vec2{x, y + h - radii.Y})
+	c.pathArcSegments(n, Vec2{x + radii.X, y + h - radii.Y}, radii, math.Pi, -math.Pi/2)
+	c.pathLineTo(n, Vec2{x + w - radii.X, y + h})
+	c.pathArcSegments(n, Vec2{x + w - radii.X, y + h - radii.Y}, radii, math.Pi/2, -math.Pi/2)
+	c.pathLineTo(n, Vec2{x + w, y + radii.Y})
+	c.pathArcSegments(n, Vec2{x + w - radii.X, y + radii.Y}, radii, 0, -math.Pi/2)
+	c.pathLineTo(n, Vec2{x + radii.X, y})
+	c.pathArcSegments(n, Vec2{x + radii.X, y + radii.Y}, radii, -math.Pi/2, -math.Pi/2)
+	c.closePath(n)
+}
+
+// The macro emitters track the path's current point as the client decodes
+// it, so following path points can be sent as deltas.
+
+func (s *Server) macroBezierTo(control1 Vec2, control2 Vec2, point Vec2) {
+	s.macroOperation(ropBezierTo)
+	s.macroUseConstVec2(control1)
+	s.macroUseConstVec2(control2)
+	s.macroPathPoint = s.macroUseConstVec2(point)
+}
+
+func (s *Server) macroQuadTo(control Vec2, point Vec2) {
+	s.macroOperation(ropQuadTo)
+	s.macroUseConstVec2(control)
+	s.macroPathPoint = s.macroUseConstVec2(point)
+}
+
+func (s *Server) macroArcTo(point1 Vec2, point2 Vec2, radius float64) {
+	s.macroOperation(ropArcTo)
+	point1 = s.macroUseConstVec2(point1)
+	point2 = s.macroUseConstVec2(point2)
+	radius = s.macroUseConstNumber(radius)
+	center, start, sweep, ok := arcToArc(s.macroPathPoint, point1, point2, radius)
+	if !ok {
+		s.macroPathPoint = point1
+		return
+	}
+	s.macroArcPath(center, Vec2{radius, radius}, start, sweep)
+}
+
+func (s *Server) macroArc(center Vec2, radius float64, start float64, sweep float64) {
+	s.macroOperation(ropArc)
+	center = s.macroUseConstVec2(center)
+	radius = s.macroUseConstNumber(radius)
+	start = s.macroUseConstNumber(start)
+	sweep = s.macroUseConstNumber(sweep)
+	s.macroArcPath(center, Vec2{radius, radius}, start, clampSweep(sweep))
+}
+
+// macroArcPath tracks the path through an arc the way the client's pathArc
+// draws it.
+func (s *Server) macroArcPath(center Vec2, radii Vec2, start float64, sweep float64) {
+	if !s.macroPathStarted {
+		s.macroSubpathStart = ellipsePoint(center, radii, start)
+		s.macroPathStarted = true
+	}
+	s.macroPathPoint = ellipsePoint(center, radii, start+sweep)
+}
+
+func (s *Server) macroEllipse(center Vec2, radii Vec2) {
+	s.macroOperation(ropEllipse)
+	center = s.macroUseConstVec2(center)
+	radii = s.macroUseConstVec2(radii)
+	s.macroClosedSubpath(ellipsePoint(center, radii, math.Pi))
+}
+
+func (s *Server) macroRectangle(position Vec2, size Vec2) {
+	s.macroOperation(ropRect)
+	position = s.macroUseConstVec2(position)
+	s.macroUseConstVec2(size)
+	s.macroClosedSubpath(position)
+}
+
+func (s *Server) macroRoundedRectangle(position Vec2, size Vec2, radius float64) {
+	s.macroOperation(ropRoundedRect)
+	position = s.macroUseConstVec2(position)
+	size = s.macroUseConstVec2(size)
+	radii := roundedRectRadii(size, s.macroUseConstNumber(radius))
+	s.macroClosedSubpath(Vec2{position.X, position.Y + radii.Y})
+}
+
+func (s *Server) macroClosedSubpath(start Vec2) {
+	s.macroPathPoint = start
+	s.macroSubpathStart = start
+	s.macroPathStarted = true
+	s.macroPathKnown = true
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// recordedPath is a pathDrawer keeping the points of every path command.
+type recordedPath struct {
+	commands []pathCommand
+}
+
+type pathCommand struct {
+	name   string
+	points []Vec2
+}
+
+func (p *recordedPath) add(name string, coordinates ...float32) {
+	var points []Vec2
+	for i := 0; i < len(coordinates); i += 2 {
+		points = append(points, Vec2{float64(coordinates[i]), float64(coordinates[i+1])})
+	}
+	p.commands = append(p.commands, pathCommand{name, points})
+}
+
+func (p *recordedPath) MoveTo(x, y float32) { p.add("MoveTo", x, y) }
+func (p *recordedPath) LineTo(x, y float32) { p.add("LineTo", x, y) }
+func (p *recordedPath) BezierTo(c1x, c1y, c2x, c2y, x, y float32) {
+	p.add("BezierTo", c1x, c1y, c2x, c2y, x, y)
+}
+func (p *recordedPath) ClosePath() { p.add("ClosePath") }
+
+// expectedStep is a command the path should hold, with the points in window
+// coordinates it must pass through: the end point and, for curves, the point
+// halfway.
+type expectedStep struct {
+	name    string
+	end     Vec2
+	halfway Vec2
+}
+
+func TestCurvesUnderRotationAndScale(t *testing.T) {
+	const rotation = 2 * math.Pi * 3 / 16
+	position, scale := Vec2{100, 50}, Vec2{2, 0.5}
+	transform := func(p Vec2) Vec2 {
+		x, y := p.X*scale.X, p.Y*scale.Y
+		return Vec2{
+			position.X + x*math.Cos(rotation) - y*math.Sin(rotation),
+			position.Y + x*math.Sin(rotation) + y*math.Cos(rotation),
+		}
+	}
+	move := func(p Vec2) expectedStep { return expectedStep{name: "MoveTo", end: transform(p)} }
+	line := func(p Vec2) expectedStep { return expectedStep{name: "LineTo", end: transform(p)} }
+	closed := expectedStep{name: "ClosePath"}
+	curve := func(halfway Vec2, end Vec2) expectedStep {
+		return expectedStep{"BezierTo", transform(end), transform(halfway)}
+	}
+	// arc returns the quarter turn segments of an elliptical arc
+	arc := func(center Vec2, radii Vec2, start float64, sweeps ...float64) []expectedStep {
+		var steps []expectedStep
+		for _, sweep := range sweeps {
+			steps = append(steps, curve(ellipsePoint(center, radii, start+sweep/2), ellipsePoint(center, radii, start+sweep)))
+			start += sweep
+		}
+		return steps
+	}
+	join := func(parts ...interface{}) []expectedStep {
+		var steps []expectedStep
+		for _, part := range parts {
+			if step, ok := part.(expectedStep); ok {
+				steps = append(steps, step)
+			} else {
+				steps = append(steps, part.([]expectedStep)...)
+			}
+		}
+		return steps
+	}
+	quarter := math.Pi / 2
+
+	tests := []struct {
+		name   string
+		opcode uint8
+		draw   func(s *Server)
+		want   []expectedStep
+	}{
+		{
+			"bezier", ropBezierTo,
+			func(s *Server) { s.macroBezierTo(Vec2{0, 20}, Vec2{30, 20}, Vec2{30, 0}) },
+			// B(1/2) = (P0 + 3 C1 + 3 C2 + P3) / 8
+			[]expectedStep{move(Vec2{}), curve(Vec2{15, 15}, Vec2{30, 0})},
+		},
+		{
+			"quad", ropQuadTo,
+			func(s *Server) { s.macroQuadTo(Vec2{20, 40}, Vec2{40, 0}) },
+			// Q(1/2) = (P0 + 2 C + P2) / 4
+			[]expectedStep{move(Vec2{}), curve(Vec2{20, 20}, Vec2{40, 0})},
+		},
+		{
+			"arc", ropArc,
+			func(s *Server) { s.macroArc(Vec2{10, 10}, 5, 0, -1.5*math.Pi) },
+			join(move(Vec2{}), line(Vec2{15, 10}), arc(Vec2{10, 10}, Vec2{5, 5}, 0, -quarter, -quarter, -quarter)),
+		},
+		{
+			"arcTo", ropArcTo,
+			func(s *Server) { s.macroArcTo(Vec2{10, 0}, Vec2{10, 10}, 2) },
+			join(move(Vec2{}), line(Vec2{8, 0}), arc(Vec2{8, 2}, Vec2{2, 2}, -quarter, quarter)),
+		},
+		{
+			"ellipse", ropEllipse,
+			func(s *Server) { s.macroEllipse(Vec2{0, 0}, Vec2{20, 10}) },
+			join(move(Vec2{}), move(Vec2{-20, 0}), arc(Vec2{}, Vec2{20, 10}, math.Pi, -quarter, -quarter, -quarter, -quarter), closed),
+		},
+		{
+			"roundedRect", ropRoundedRect,
+			func(s *Server) { s.macroRoundedRectangle(Vec2{0, 0}, Vec2{40, 20}, 5) },
+			join(move(Vec2{}),
+				move(Vec2{0, 5}), line(Vec2{0, 15}), arc(Vec2{5, 15}, Vec2{5, 5}, math.Pi, -quarter),
+				line(Vec2{35, 20}), arc(Vec2{35, 15}, Vec2{5, 5}, quarter, -quarter),
+				line(Vec2{40, 5}), arc(Vec2{35, 5}, Vec2{5, 5}, 0, -quarter),
+				line(Vec2{5, 0}), arc(Vec2{5, 5}, Vec2{5, 5}, -quarter, -quarter),
+				closed),
+		},
+	}
+	for _, test := range tests {
+		server, client := newTestSession(t)
+		var node NodeNumber
+		var macroPathPoint Vec2
+		sendFrame(t, server, client, func() {
+			macroNumber := server.macroStart()
+			server.macroBeginPath()
+			server.macroMoveTo(Vec2{})
+			test.draw(server)
+			macroPathPoint = server.macroPathPoint
+			server.macroEnd()
+			node = server.nodeCreate()
+			server.nodeSetContent(node, macroNumber)
+			server.nodeSetPosition(node, position)
+			server.nodeSetRotation(node, rotation)
+			server.nodeSetScale(node, scale)
+		})
+		path := &recordedPath{}
+		client.path = path
+		points := renderTestNode(t, client, node, test.opcode)
+		if len(points) != 1 || !closePoints(points[0], macroPathPoint) {
+			t.Fatalf("%s: client path point %v, server tracks %v", test.name, points, macroPathPoint)
+		}
+
+		if len(path.commands) != len(test.want) {
+			t.Fatalf("%s: drew %v, want %d commands", test.name, path.commands, len(test.want))
+		}
+		var current Vec2
+		for i, want := range test.want {
+			command := path.commands[i]
+			if command.name != want.name {
+				t.Fatalf("%s: command %d is %s, want %s", test.name, i, command.name, want.name)
+			}
+			if command.name == "ClosePath" {
+				continue
+			}
+			end := command.points[len(command.points)-1]
+			if math.Hypot(end.X-want.end.X, end.Y-want.end.Y) > 1e-3 {
+				t.Fatalf("%s: command %d ends at %v, want %v", test.name, i, end, want.end)
+			}
+			if command.name == "BezierTo" {
+				c1, c2 := command.points[0], command.points[1]
+				halfway := current.Add(c1.MultiplyFloat(3)).Add(c2.MultiplyFloat(3)).Add(end).DivideFloat(8)
+				// a quarter turn Bézier is off the circle by less than 3e-4 of its radius
+				if math.Hypot(halfway.X-want.halfway.X, halfway.Y-want.halfway.Y) > 0.02 {
+					t.Fatalf("%s: command %d passes %v halfway, want %v", test.name, i, halfway, want.halfway)
+				}
+			}
+			current = end
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import "fmt"
+
+type ErrorKind int
+
+const (
+	errorOutOfRange ErrorKind = iota
+	errorUnknownOpcode
+	errorUnknownNode
+	errorUnknownMacro
+	errorUnknownAnchor
+	errorDuplicateID
+	errorInvalidState
+	errorRead
+	errorChecksum
+)
+
+var errorKindNames = [...]string{
+	"out of range read", "unknown opcode", "unknown node", "unknown macro", "unknown anchor", "duplicate id",
+	"invalid state", "read error", "checksum mismatch",
+}
+
+func (k ErrorKind) String() string {
+	return errorKindNames[k]
+}
+
+// DecodeError describes why a stream could not be decoded and where: the byte
+// offset in the bytecode being decoded and the last opcode read from it.
+type DecodeError struct {
+	kind        ErrorKind
+	offset      int
+	opcode      uint8
+	render      bool // opcode is a render opcode
+	description string
+}
+
+func (e *DecodeError) Kind() ErrorKind {
+	return e.kind
+}
+
+func (e *DecodeError) Error() string {
+	if e.offset < 0 {
+		return fmt.Sprint(e.kind, ": ", e.description)
+	}
+	return fmt.Sprint(e.kind, " at offset ", e.offset, " after ", opcodeName(e.render, e.opcode), ": ", e.description)
+}
+
+// recoverDecodeError stops a panic raised by Bytecode.error and stores the
+// DecodeError in err. Any other panic is passed on.
+func recoverDecodeError(err *error) {
+	if r := recover(); r != nil {
+		decodeError, ok := r.(*DecodeError)
+		if !ok {
+			panic(r)
+		}
+		*err = decodeError
+	}
+}
+
+func isChecksumError(err error) bool {
+	decodeError, ok := err.(*DecodeError)
+	return ok && decodeError.kind == errorChecksum
+}
+
+// EncodeError describes a value the server can't represent in the encoding
+// negotiated for the stream.
+type EncodeError struct {
+	description string
+}
+
+func (e *EncodeError) Error() string {
+	return "encode error: " + e.description
+}
+
+// recoverEncodeError stops a panic raised by Bytecode.encodeError and stores the
+// EncodeError in err. Any other panic is passed on.
+func recoverEncodeError(err *error) {
+	if r := recover(); r != nil {
+		encodeError, ok := r.(*EncodeError)
+		if !ok {
+			panic(r)
+		}
+		*err = encodeError
+	}
+}
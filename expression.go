@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/shibukawa/nanovgo"
+)
+
+// Render code can compute values on a stack before using them. The push
+// operations put numbers on the stack, a vec2 as x then y and a color as red,
+// green, blue and alpha from 0 to 1; the arithmetic operations replace the top
+// values with the result. ropApply runs a render operation with its operands
+// popped from the stack, so a macro can derive points, colors and sizes from
+// its variables. The stack starts out empty for every node and is shared by
+// the macros it calls.
+
+// maxValueStackSize bounds the value stack of a node's render code.
+const maxValueStackSize = 256
+
+// stackValueCount returns how many stack values an operand of ropApply takes,
+// 0 if it can't be taken from the stack.
+func stackValueCount(operandType OperandType) int {
+	switch operandType {
+	case operandUint8, operandUint16, operandNumber, operandRotation:
+		return 1
+	case operandVec2, operandScale:
+		return 2
+	case operandRgba:
+		return 4
+	case operandAffine:
+		return 6
+	}
+	return 0
+}
+
+func (c *Client) pushValues(values ...float64) {
+	if len(c.values)+len(values) > maxValueStackSize {
+		c.error(errorOutOfRange, "value stack larger than "+fmt.Sprint(maxValueStackSize))
+	}
+	c.values = append(c.values, values...)
+}
+
+// popValues removes the top count values and returns them, the oldest first.
+func (c *Client) popValues(count int) []float64 {
+	if count > len(c.values) {
+		c.error(errorInvalidState, fmt.Sprint("value stack holds ", len(c.values), " values, ", count, " needed"))
+	}
+	values := c.values[len(c.values)-count:]
+	c.values = c.values[:len(c.values)-count]
+	return values
+}
+
+func (c *Client) pushNumber(n *Node) {
+	c.pushValues(c.popFloat64())
+}
+
+func (c *Client) pushVec2(n *Node) {
+	vec2 := c.popVec2()
+	c.pushValues(vec2.X, vec2.Y)
+}
+
+func (c *Client) pushRgba(n *Node) {
+	color := c.popRgba()
+	c.pushValues(float64(color.R), float64(color.G), float64(color.B), float64(color.A))
+}
+
+func (c *Client) unaryOperation(operation func(float64) float64) func(*Node) {
+	return func(n *Node) {
+		values := c.popValues(1)
+		c.pushValues(operation(values[0]))
+	}
+}
+
+func (c *Client) binaryOperation(operation func(float64, float64) float64) func(*Node) {
+	return func(n *Node) {
+		values := c.popValues(2)
+		c.pushValues(operation(values[0], values[1]))
+	}
+}
+
+// apply runs a render operation with its operands taken from the value stack.
+func (c *Client) apply(n *Node) {
+	opcode := c.popUint8()
+	if opcode >= ropCodeCount {
+		c.error(errorUnknownOpcode, "apply: invalid render opcode: "+fmt.Sprint(opcode))
+	}
+	description := renderOpcodes[opcode]
+	if blockOpcode(opcode) {
+		c.error(errorInvalidState, "apply: "+description.name+" can't be applied")
+	}
+	count := 0
+	for _, operandType := range description.operands {
+		if stackValueCount(operandType) == 0 {
+			c.error(errorInvalidState, fmt.Sprint("apply: ", description.name, " takes a ", operandType, " operand"))
+		}
+		count += stackValueCount(operandType)
+	}
+	values := c.popValues(count)
+	for _, value := range values {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			c.error(errorOutOfRange, fmt.Sprint("apply: ", description.name, " operand ", value))
+		}
+	}
+	operands := NewBytecode()
+	operands.numberFormat = numberFormatFloat64
+	for _, operandType := range description.operands {
+		count := stackValueCount(operandType)
+		c.pushStackOperand(operands, operandType, values[:count])
+		values = values[count:]
+	}
+	c.pushState(operands)
+	c.renderOperations[opcode](n)
+	c.popState()
+}
+
+func (c *Client) pushStackOperand(b *Bytecode, operandType OperandType, values []float64) {
+	switch operandType {
+	case operandUint8, operandUint16:
+		limit := float64(math.MaxUint8)
+		if operandType == operandUint16 {
+			limit = math.MaxUint16
+		}
+		value := math.Round(values[0])
+		if value < 0 || value > limit {
+			c.error(errorOutOfRange, fmt.Sprint("apply: ", operandType, " operand ", values[0]))
+		}
+		if operandType == operandUint8 {
+			b.pushUint8(uint8(value))
+		} else {
+			b.pushUint16(uint16(value))
+		}
+	case operandNumber:
+		b.pushFloat64(values[0])
+	case operandRotation:
+		b.pushRotation(values[0])
+	case operandVec2:
+		b.pushVec2(Vec2{values[0], values[1]})
+	case operandScale:
+		b.pushScale(Vec2{values[0], values[1]})
+	case operandRgba:
+		var components [4]float32
+		for i := range components {
+			components[i] = float32(math.Max(0, math.Min(1, values[i])))
+		}
+		b.pushRgba(nanovgo.Color{R: components[0], G: components[1], B: components[2], A: components[3]})
+	case operandAffine:
+		b.pushAffine(Matrix33{
+			m00: values[0], m01: values[1], m02: values[2],
+			m10: values[3], m11: values[4], m12: values[5],
+			m22: 1,
+		})
+	}
+}
+
+// macroPushVar adds pushing a variable of the macro being defined onto the
+// value stack.
+func (s *Server) macroPushVar(variableNumber uint16) {
+	if int(variableNumber) >= len(s.wipVariables) {
+		s.encodeError(fmt.Sprint("macroPushVar: undeclared variable ", variableNumber))
+	}
+	switch variableType := s.wipVariables[variableNumber]; variableType {
+	case operandNumber:
+		s.macroOperation(ropPushNumber)
+	case operandVec2:
+		s.macroOperation(ropPushVec2)
+	case operandRgba:
+		s.macroOperation(ropPushRgba)
+	default:
+		s.encodeError(fmt.Sprint("macroPushVar: ", variableType, " variables can't be pushed"))
+	}
+	s.macroUseVar(variableNumber)
+}
+
+// macroPushConst adds pushing a float64, Vec2 or nanovgo.Color onto the value
+// stack.
+func (s *Server) macroPushConst(value interface{}) {
+	opcode := uint8(ropPushNumber)
+	switch value.(type) {
+	case Vec2:
+		opcode = ropPushVec2
+	case nanovgo.Color:
+		opcode = ropPushRgba
+	}
+	s.macroOperation(opcode)
+	constBytecode := s.newConstBytecode()
+	if !constBytecode.pushOperand(renderOpcodes[opcode].operands[0], value) {
+		s.encodeError(fmt.Sprintf("macroPushConst: %T values can't be pushed", value))
+	}
+	s.macroUseConst(constBytecode.bytes)
+}
+
+// macroApply adds running a render operation with its operands popped from
+// the value stack.
+func (s *Server) macroApply(opcode uint8) {
+	s.macroOperation(ropApply)
+	s.macroUseConstUint8(opcode)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestValueStackOrder(t *testing.T) {
+	c := NewClient(nil)
+	c.pushValues(1, 2)
+	c.pushValues(3)
+	if values := c.popValues(2); len(values) != 2 || values[0] != 2 || values[1] != 3 {
+		t.Fatalf("popped %v, want [2 3]", values)
+	}
+	if values := c.popValues(1); values[0] != 1 || len(c.values) != 0 {
+		t.Fatalf("popped %v leaving %v, want [1] leaving none", values, c.values)
+	}
+
+	// the value pushed first is the left operand
+	c.pushValues(5, 2)
+	c.binaryOperation(func(a, b float64) float64 { return a - b })(nil)
+	if len(c.values) != 1 || c.values[0] != 3 {
+		t.Fatalf("5 - 2 left %v, want [3]", c.values)
+	}
+}
+
+func TestValueStackLimits(t *testing.T) {
+	c := NewClient(nil)
+	c.pushValues(1)
+	err := catchDecodeError(func() { c.popValues(2) })
+	if !isDecodeErrorKind(err, errorInvalidState) || len(c.values) != 1 {
+		t.Fatalf("popping 2 of 1 values returned %v leaving %v, want an errorInvalidState DecodeError", err, c.values)
+	}
+
+	c.pushValues(make([]float64, maxValueStackSize-1)...)
+	err = catchDecodeError(func() { c.pushValues(1) })
+	if !isDecodeErrorKind(err, errorOutOfRange) || len(c.values) != maxValueStackSize {
+		t.Fatalf("pushing past %d values returned %v, want an errorOutOfRange DecodeError", maxValueStackSize, err)
+	}
+}
+
+func TestStackOperandRange(t *testing.T) {
+	tests := []struct {
+		operandType OperandType
+		value       float64
+		want        uint16
+		ok          bool
+	}{
+		{operandUint8, 2.4, 2, true},
+		{operandUint8, 2.5, 3, true},
+		{operandUint8, -0.4, 0, true},
+		{operandUint8, -0.5, 0, false},
+		{operandUint8, 255.4, 255, true},
+		{operandUint8, 255.5, 0, false},
+		{operandUint16, 1000.6, 1001, true},
+		{operandUint16, math.MaxUint16 + 0.4, math.MaxUint16, true},
+		{operandUint16, math.MaxUint16 + 0.5, 0, false},
+	}
+	c := NewClient(nil)
+	for _, test := range tests {
+		b := NewBytecode()
+		err := catchDecodeError(func() { c.pushStackOperand(b, test.operandType, []float64{test.value}) })
+		if !test.ok {
+			if !isDecodeErrorKind(err, errorOutOfRange) {
+				t.Fatalf("%s %v returned %v, want an errorOutOfRange DecodeError", test.operandType, test.value, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s %v: %v", test.operandType, test.value, err)
+		}
+		value := uint16(b.popUint8())
+		if test.operandType == operandUint16 {
+			b = NewBytecodeFromBytes(b.bytes)
+			value = b.popUint16()
+		}
+		if value != test.want {
+			t.Fatalf("%s %v read back as %d, want %d", test.operandType, test.value, value, test.want)
+		}
+	}
+
+	b := NewBytecode()
+	c.pushStackOperand(b, operandRgba, []float64{-0.5, 0.6, 1.5, 1})
+	if color := b.popRgba(); color.R != 0 || color.G != 0.6 || color.B != 1 || color.A != 1 {
+		t.Fatalf("rgba read back as %v, want {0 0.6 1 1}", color)
+	}
+}
+
+func TestApplyDraws(t *testing.T) {
+	server, client := newTestSession(t)
+	var node NodeNumber
+	sendFrame(t, server, client, func() {
+		macroNumber := server.macroStart()
+		server.macroBeginPath()
+		server.macroPushConst(Vec2{10, 20})
+		server.macroApply(ropMoveTo)
+		server.macroPushConst(30.0)
+		server.macroPushConst(5.0)
+		server.macroOperation(ropAdd)
+		server.macroPushConst(40.0)
+		server.macroApply(ropLineTo)
+		server.macroEnd()
+		node = server.nodeCreate()
+		server.nodeSetContent(node, macroNumber)
+	})
+	points := renderTestNode(t, client, node, ropApply)
+	if want := []Vec2{{10, 20}, {35, 40}}; !samePoints(points, want) {
+		t.Fatalf("applied path points %v, want %v", points, want)
+	}
+	if len(client.values) != 0 {
+		t.Fatalf("%d values left on the stack", len(client.values))
+	}
+}
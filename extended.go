@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Extended operations are uopExtended or ropExtended followed by an extended
+// code and the length of the operands, so a client that doesn't know the code
+// can skip the operation and keep going. The plain opcodes are fixed for a
+// protocol version; operations added without a version bump, which older
+// viewers in a mixed deployment have to tolerate, are extended codes.
+
+type ExtendedCode uint16
+
+func (b *Bytecode) pushExtendedCode(code ExtendedCode) {
+	b.pushId(uint16(code))
+}
+
+func (b *Bytecode) popExtendedCode() ExtendedCode {
+	return ExtendedCode(b.popId())
+}
+
+// pushBlockLength writes the operand length of an extended operation, a
+// uint16 or a varint.
+func (b *Bytecode) pushBlockLength(length int) {
+	if length > math.MaxUint16 {
+		b.encodeError("pushBlockLength: length uint16 overflow")
+	}
+	b.pushId(uint16(length))
+}
+
+func (b *Bytecode) popBlockLength() int {
+	return int(b.popId())
+}
+
+// skip reads past count bytes, for streaming bytecode in pieces that fit the
+// buffer.
+func (b *Bytecode) skip(count int) {
+	for count > 0 {
+		n := count
+		if n > streamBufferSize {
+			n = streamBufferSize
+		}
+		b.popBytes(n)
+		count -= n
+	}
+}
+
+// offset is the position in the whole stream, which for streaming bytecode
+// isn't b.i.
+func (b *Bytecode) offset() int {
+	return b.discarded + b.i
+}
+
+// extendedOperation runs the handler of an extended operation, or skips it
+// with a warning if the code isn't known. The handler has to read exactly the
+// operand bytes.
+func (c *Client) extendedOperation(render bool, run func(code ExtendedCode) bool) {
+	code := c.popExtendedCode()
+	length := c.popBlockLength()
+	end := c.offset() + length
+	if !run(code) {
+		kind := "update"
+		if render {
+			kind = "render"
+		}
+		c.warn(fmt.Sprint("skipping unknown extended ", kind, " operation ", code))
+		c.skip(length)
+		return
+	}
+	if c.offset() != end {
+		c.error(errorInvalidState, fmt.Sprint("extended operation ", code, " read ", c.offset()-end+length, " operand bytes of ", length))
+	}
+}
+
+func (c *Client) updateExtended() {
+	c.extendedOperation(false, func(code ExtendedCode) bool {
+		operation, ok := c.extendedUpdateOperations[code]
+		if ok {
+			operation()
+		}
+		return ok
+	})
+}
+
+func (c *Client) renderExtended(n *Node) {
+	c.extendedOperation(true, func(code ExtendedCode) bool {
+		operation, ok := c.extendedRenderOperations[code]
+		if ok {
+			operation(n)
+		}
+		return ok
+	})
+}
+
+// warn prints a warning the first time it comes up.
+func (c *Client) warn(warning string) {
+	if c.warnings[warning] {
+		return
+	}
+	c.warnings[warning] = true
+	fmt.Println("warning: ", warning)
+}
+
+// extended writes an extended update operation. operands encodes the operands
+// in the stream's encoding.
+func (s *Server) extended(code ExtendedCode, operands func(b *Bytecode)) {
+	block := NewBytecode().applyHeader(s.header)
+	operands(block)
+	s.update(uopExtended, code, block.bytes)
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestUnknownExtendedOperationsAreSkipped(t *testing.T) {
+	server, client := newTestSession(t)
+	unknown := NewExtendedCode(200, 1)
+	var node NodeNumber
+	sendFrame(t, server, client, func() {
+		server.extended(unknown, func(b *Bytecode) {
+			b.pushVec2(Vec2{1, 2})
+			b.pushUint8(7)
+		})
+		server.nodeSetPosition(testNode1, Vec2{30, 40})
+
+		macroNumber := server.macroStart()
+		server.macroBeginPath()
+		server.macroOperation(ropExtended)
+		constBytecode := server.newConstBytecode()
+		constBytecode.pushExtendedCode(unknown)
+		server.macroUseConst(constBytecode.bytes)
+		constBytecode = server.newConstBytecode()
+		constBytecode.pushBlockLength(3)
+		constBytecode.pushBytes([]byte{1, 2, 3})
+		server.macroUseConst(constBytecode.bytes)
+		server.macroMoveTo(Vec2{5, 6})
+		server.macroEnd()
+		node = server.nodeCreate()
+		server.nodeSetContent(node, macroNumber)
+	})
+	if position := client.nodes[testNode1].position; position != (Vec2{30, 40}) {
+		t.Fatalf("operation after the unknown one set position %v, want {30 40}", position)
+	}
+	if points := renderTestNode(t, client, node, ropMoveTo); !samePoints(points, []Vec2{{5, 6}}) {
+		t.Fatalf("render operation after the unknown one moved to %v, want {5 6}", points)
+	}
+	if len(client.warnings) != 2 {
+		t.Fatalf("warnings %v, want one for each unknown operation", client.warnings)
+	}
+}
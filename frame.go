@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+// Update batches travel in frames: payload length, sequence number and the
+// server time the frame was produced, followed by the payload itself. Frames
+// can be cut at any read boundary and concatenated into files. With
+// featureVarint the three header fields are varints. With featureChecksum the
+// payload is followed by a CRC32C of the frame header and payload.
+
+const frameHeaderSize = 4 + 4 + 4
+const frameChecksumSize = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func frameChecksum(header []byte, payload []byte) uint32 {
+	return crc32.Update(crc32.Checksum(header, castagnoli), castagnoli, payload)
+}
+
+func checksumError(expected uint32, computed uint32) *DecodeError {
+	return &DecodeError{
+		kind:        errorChecksum,
+		offset:      -1,
+		description: fmt.Sprintf("frame checksum %#08x, computed %#08x", expected, computed),
+	}
+}
+
+type Frame struct {
+	sequence  uint32
+	timestamp uint32 // milliseconds since the start of the stream
+	payload   []byte
+}
+
+// FrameGap reports a discontinuity in the frame sequence. A gap means frames
+// were lost, a received sequence older than the expected one means a frame was
+// reordered or duplicated.
+type FrameGap struct {
+	expected uint32
+	received uint32
+}
+
+func (g FrameGap) Reordered() bool {
+	return int32(g.received-g.expected) < 0
+}
+
+func (g FrameGap) Missing() int {
+	if g.Reordered() {
+		return 0
+	}
+	return int(g.received - g.expected)
+}
+
+func (g FrameGap) String() string {
+	if g.Reordered() {
+		return fmt.Sprint("reordered frame ", g.received, ", expected ", g.expected)
+	}
+	return fmt.Sprint("missing frames ", g.expected, "-", g.received-1)
+}
+
+func (b *Bytecode) pushFrame(frame Frame) {
+	b.pushFrameHeader(len(frame.payload), frame)
+	b.pushBytes(frame.payload)
+}
+
+func (b *Bytecode) pushFrameHeader(length int, frame Frame) {
+	for _, field := range [3]uint32{uint32(length), frame.sequence, frame.timestamp} {
+		if b.varint {
+			b.pushUvarint(uint64(field))
+		} else {
+			b.pushUint32(field)
+		}
+	}
+}
+
+// pushFrameChecksum appends the checksum of a frame pushed from offset start.
+func (b *Bytecode) pushFrameChecksum(start int) {
+	b.pushUint32(crc32.Checksum(b.bytes[start:], castagnoli))
+}
+
+// maxResyncGap bounds how many frames after the last good one a frame found
+// while resyncing may be. Only offsets where such a frame header is, with a
+// timestamp that doesn't go back, are checksummed.
+const maxResyncGap = 1 << 10
+
+// FrameDecoder collects stream bytes and hands out complete frames.
+type FrameDecoder struct {
+	buffered []byte
+	varint   bool
+	checksum bool
+	resync   bool // the last frame was corrupt, look for the next frame
+	started  bool // a frame was handed out, the fields below are valid
+	sequence uint32
+	time     uint32
+}
+
+func (d *FrameDecoder) Write(bytes []byte) {
+	d.buffered = append(d.buffered, bytes...)
+}
+
+// readHeader returns the length, sequence and timestamp of the buffered frame
+// and the size of its header, or a zero size if the header isn't complete.
+func (d *FrameDecoder) readHeader() (fields [3]uint32, size int, err error) {
+	if !d.varint {
+		if len(d.buffered) < frameHeaderSize {
+			return fields, 0, nil
+		}
+		header := NewBytecodeFromBytes(d.buffered)
+		for i := range fields {
+			fields[i] = header.popUint32()
+		}
+		return fields, frameHeaderSize, nil
+	}
+	for i := range fields {
+		value, n := binary.Uvarint(d.buffered[size:])
+		if n == 0 {
+			return fields, 0, nil
+		}
+		if n < 0 || value > math.MaxUint32 {
+			return fields, 0, &DecodeError{kind: errorOutOfRange, offset: size, description: "frame header varint overflow"}
+		}
+		fields[i] = uint32(value)
+		size += n
+	}
+	return fields, size, nil
+}
+
+// Next returns the next complete frame, or false if more bytes are needed. A
+// frame failing its checksum is returned as an errorChecksum DecodeError, a
+// frame header that can't be right as an error too. With checksums the decoder
+// then resyncs to the next frame whose checksum matches, since the corrupt
+// length can't be trusted to find it.
+func (d *FrameDecoder) Next() (Frame, bool, error) {
+	if d.resync && !d.findFrame() {
+		return Frame{}, false, nil
+	}
+	fields, headerSize, err := d.readHeader()
+	if err == nil && fields[0] > maxFrameSize {
+		err = &DecodeError{kind: errorOutOfRange, offset: 0, description: "frame larger than maxFrameSize"}
+	}
+	if err != nil {
+		if d.checksum {
+			d.buffered = d.buffered[1:]
+			d.resync = true
+		}
+		return Frame{}, false, err
+	}
+	if headerSize == 0 {
+		return Frame{}, false, nil
+	}
+	length := int(fields[0])
+	size := headerSize + length
+	if d.checksum {
+		size += frameChecksumSize
+	}
+	if len(d.buffered) < size {
+		return Frame{}, false, nil
+	}
+	frame := Frame{
+		sequence:  fields[1],
+		timestamp: fields[2],
+		payload:   d.buffered[headerSize : headerSize+length],
+	}
+	if d.checksum {
+		expected := NewBytecodeFromBytes(d.buffered[headerSize+length : size]).popUint32()
+		if computed := frameChecksum(d.buffered[:headerSize], frame.payload); computed != expected {
+			d.buffered = d.buffered[1:]
+			d.resync = true
+			return Frame{}, false, checksumError(expected, computed)
+		}
+	}
+	d.buffered = d.buffered[size:]
+	if len(d.buffered) == 0 {
+		d.buffered = nil
+	}
+	d.started, d.sequence, d.time = true, frame.sequence, frame.timestamp
+	return frame, true, nil
+}
+
+// findFrame drops the buffered bytes before the first frame whose checksum
+// matches. If there is none yet, it drops the bytes that can't start one and
+// returns false.
+func (d *FrameDecoder) findFrame() bool {
+	undecided := len(d.buffered)
+	for start := range d.buffered {
+		complete, valid := d.checkFrameAt(start)
+		if valid {
+			d.buffered = d.buffered[start:]
+			d.resync = false
+			return true
+		}
+		if !complete && start < undecided {
+			undecided = start
+		}
+	}
+	d.buffered = d.buffered[undecided:]
+	if len(d.buffered) == 0 {
+		d.buffered = nil
+	}
+	return false
+}
+
+// checkFrameAt reports whether the bytes from start hold a complete frame
+// header and payload, and whether its checksum matches.
+func (d *FrameDecoder) checkFrameAt(start int) (complete bool, valid bool) {
+	candidate := FrameDecoder{buffered: d.buffered[start:], varint: d.varint}
+	fields, headerSize, err := candidate.readHeader()
+	if err != nil || fields[0] > maxFrameSize {
+		return true, false
+	}
+	if headerSize > 0 && d.started && (fields[1]-d.sequence-1 >= maxResyncGap || fields[2] < d.time) {
+		return true, false
+	}
+	size := headerSize + int(fields[0]) + frameChecksumSize
+	if headerSize == 0 || len(candidate.buffered) < size {
+		return false, false
+	}
+	payloadEnd := size - frameChecksumSize
+	expected := NewBytecodeFromBytes(candidate.buffered[payloadEnd:size]).popUint32()
+	return true, frameChecksum(candidate.buffered[:headerSize], candidate.buffered[headerSize:payloadEnd]) == expected
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOversizedFrameLengthResyncs(t *testing.T) {
+	server := NewServer()
+	server.features = featureChecksum
+	client := NewClient(nil)
+	answer, err := client.Handshake(server.Offer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Accept(answer); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := server.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Update(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	var stream []byte
+	for i := 0; i < 6; i++ {
+		frame, err := server.Update()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			// the high byte of the payload length
+			frame[3] ^= 0xff
+		}
+		stream = append(stream, frame...)
+	}
+	_, err = client.Update(stream)
+	if decodeError, ok := err.(*DecodeError); !ok || decodeError.kind != errorOutOfRange {
+		t.Fatalf("Update returned %v, want an errorOutOfRange DecodeError", err)
+	}
+	if client.corruptedFrames != 1 {
+		t.Fatalf("%d corrupted frames, want 1", client.corruptedFrames)
+	}
+	if len(client.frames.buffered) != 0 {
+		t.Fatalf("%d bytes left buffered", len(client.frames.buffered))
+	}
+	if client.nextSequence != server.sequence {
+		t.Fatalf("next sequence %d, want %d", client.nextSequence, server.sequence)
+	}
+}
+
+func TestResyncWaitsForPartialFrame(t *testing.T) {
+	server := NewServer()
+	server.features = featureChecksum
+	server.header = NewStreamHeader(server.numberFormat, featureChecksum)
+	server.handshakeDone = true
+	if err := server.buildInit(); err != nil {
+		t.Fatal(err)
+	}
+	good := server.frame()
+	decoder := FrameDecoder{checksum: true}
+	corrupt := append([]byte{}, good...)
+	corrupt[3] ^= 0xff
+	decoder.Write(corrupt)
+	decoder.Write(good[:len(good)/2])
+	if _, ok, err := decoder.Next(); ok || err == nil {
+		t.Fatalf("corrupt frame gave ok %v, error %v", ok, err)
+	}
+	if _, ok, err := decoder.Next(); ok || err != nil {
+		t.Fatalf("partial frame gave ok %v, error %v", ok, err)
+	}
+	decoder.Write(good[len(good)/2:])
+	received, ok, err := decoder.Next()
+	if !ok || err != nil || received.sequence != 0 {
+		t.Fatalf("frame after resync: sequence %d, ok %v, error %v", received.sequence, ok, err)
+	}
+}
+
+// checkedFrames returns a checksummed session and its next update frames.
+func checkedFrames(t *testing.T, count int) (*Server, *Client, [][]byte) {
+	t.Helper()
+	server, client := connectTestClient(t, featureChecksum)
+	frame, err := server.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Update(frame); err != nil {
+		t.Fatal(err)
+	}
+	frames := make([][]byte, count)
+	for i := range frames {
+		if frames[i], err = server.Update(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return server, client, frames
+}
+
+func TestShortenedFrameLengthResyncs(t *testing.T) {
+	server, client, frames := checkedFrames(t, 6)
+	// the length still points inside the buffer, into the next frame
+	frames[0][0] -= 3
+	gaps, err := client.Update(bytes.Join(frames, nil))
+	if !isChecksumError(err) {
+		t.Fatalf("Update returned %v, want a checksum error", err)
+	}
+	if client.corruptedFrames != 1 || len(gaps) != 1 || gaps[0].Missing() != 1 {
+		t.Fatalf("%d corrupted frames and gaps %v, want 1 frame missing", client.corruptedFrames, gaps)
+	}
+	if client.nextSequence != server.sequence {
+		t.Fatalf("next sequence %d, want %d", client.nextSequence, server.sequence)
+	}
+}
+
+func TestResyncSkipsImplausibleFrames(t *testing.T) {
+	server, client, frames := checkedFrames(t, 3)
+	// a well formed frame far ahead of the stream, as a payload might hold
+	stray := NewBytecode()
+	stray.pushFrame(Frame{sequence: server.sequence + maxResyncGap, timestamp: 0, payload: []byte{uopCodeCount}})
+	stray.pushFrameChecksum(0)
+	frames[0][len(frames[0])-1] ^= 0xff
+	stream := append(append(append([]byte{}, frames[0]...), stray.bytes...), frames[1]...)
+	stream = append(stream, frames[2]...)
+	gaps, err := client.Update(stream)
+	if !isChecksumError(err) {
+		t.Fatalf("Update returned %v, want a checksum error", err)
+	}
+	if client.corruptedFrames != 1 || len(gaps) != 1 || gaps[0].Missing() != 1 {
+		t.Fatalf("%d corrupted frames and gaps %v, want frame %d missing", client.corruptedFrames, gaps, server.sequence-3)
+	}
+	if client.nextSequence != server.sequence {
+		t.Fatalf("next sequence %d, want %d", client.nextSequence, server.sequence)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Every stream starts with a header: magic, protocol version, number format
+// and feature flags. The server sends its header as an offer, the
+// client answers with the subset of features it accepts, and both sides use
+// the answer for the rest of the session.
+
+var streamMagic = []byte{'V', 'S', 'T', 'R'}
+
+const protocolVersion = 2
+const minProtocolVersion = 2
+
+const streamHeaderSize = 4 + 2 + 1 + 4
+
+// optional features, negotiated in the handshake
+const (
+	// LEB128 varints for ids, sizes and coordinates in update operations and
+	// for frame headers. Render bytecode stays fixed width, macro variables are
+	// spliced into it at fixed offsets.
+	featureVarint uint32 = 1 << iota
+	// deflate compressed frame payloads, see compress.go
+	featureCompression
+	// CRC32C trailer after every frame
+	featureChecksum
+	// macros of a library file both sides load, see library.go. The offer and
+	// the answer are followed by a list of macro hashes.
+	featureLibrary
+)
+
+const supportedFeatures = featureVarint | featureCompression | featureChecksum | featureLibrary
+
+type StreamHeader struct {
+	version      uint16
+	numberFormat NumberFormat
+	features     uint32
+}
+
+func NewStreamHeader(numberFormat NumberFormat, features uint32) StreamHeader {
+	return StreamHeader{
+		version:      protocolVersion,
+		numberFormat: numberFormat,
+		features:     features,
+	}
+}
+
+func (h StreamHeader) HasFeature(feature uint32) bool {
+	return h.features&feature != 0
+}
+
+// validate checks that a header received from the other side can be decoded
+// by this build.
+func (h StreamHeader) validate() error {
+	if h.version < minProtocolVersion || h.version > protocolVersion {
+		return fmt.Errorf("unsupported protocol version %d, supported %d-%d", h.version, minProtocolVersion, protocolVersion)
+	}
+	if h.numberFormat >= numberFormatCount {
+		return fmt.Errorf("unsupported number format %d", h.numberFormat)
+	}
+	return nil
+}
+
+func (b *Bytecode) pushStreamHeader(header StreamHeader) {
+	b.pushBytes(streamMagic)
+	b.pushUint16(header.version)
+	b.pushUint8(uint8(header.numberFormat))
+	b.pushUint32(header.features)
+}
+
+func (b *Bytecode) popStreamHeader() (StreamHeader, error) {
+	header := StreamHeader{}
+	if len(b.bytes)-b.i < streamHeaderSize {
+		return header, fmt.Errorf("stream header truncated: %d bytes", len(b.bytes)-b.i)
+	}
+	if magic := b.popBytes(len(streamMagic)); !bytes.Equal(magic, streamMagic) {
+		return header, fmt.Errorf("bad stream magic %q", magic)
+	}
+	header.version = b.popUint16()
+	header.numberFormat = NumberFormat(b.popUint8())
+	header.features = b.popUint32()
+	return header, nil
+}
+
+func EncodeStreamHeader(header StreamHeader) []byte {
+	bytecode := NewBytecode()
+	bytecode.pushStreamHeader(header)
+	return bytecode.bytes
+}
+
+func DecodeStreamHeader(bytes []byte) (StreamHeader, error) {
+	header, err := NewBytecodeFromBytes(bytes).popStreamHeader()
+	if err != nil {
+		return header, err
+	}
+	return header, header.validate()
+}
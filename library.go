@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
+
+// A macro library is a file of macro definitions both sides load at startup.
+// Library macros are identified by a hash of their definition: the server
+// offers the hashes of its library in the handshake, the client answers with
+// the ones it doesn't have, and in the init frame the server binds the others
+// to macro numbers with uopMacroLoad instead of sending their definitions.
+// Macro numbers differ between sessions, so library macros can't call other
+// macros.
+//
+// The file is the magic, version and number format followed by the fixed
+// width update operations defining the macros.
+
+var libraryMagic = []byte{'V', 'S', 'M', 'L'}
+
+const libraryVersion = 1
+
+const macroHashSize = 16
+
+// MacroHash is the start of the SHA-256 of a macro's number format and
+// definition.
+type MacroHash [macroHashSize]byte
+
+func hashMacro(numberFormat NumberFormat, definition []byte) MacroHash {
+	sum := sha256.Sum256(append([]byte{uint8(numberFormat)}, definition...))
+	var hash MacroHash
+	copy(hash[:], sum[:])
+	return hash
+}
+
+func (b *Bytecode) pushMacroHash(hash MacroHash) {
+	b.pushBytes(hash[:])
+}
+
+func (b *Bytecode) popMacroHash() MacroHash {
+	var hash MacroHash
+	copy(hash[:], b.popBytes(macroHashSize))
+	return hash
+}
+
+func (b *Bytecode) pushMacroHashes(hashes []MacroHash) {
+	b.pushUvarint(uint64(len(hashes)))
+	for _, hash := range hashes {
+		b.pushMacroHash(hash)
+	}
+}
+
+func (b *Bytecode) popMacroHashes() []MacroHash {
+	count := b.popUvarint()
+	if count > uint64(len(b.bytes)-b.i)/macroHashSize {
+		b.error(errorOutOfRange, "popMacroHashes: more hashes than bytes")
+	}
+	hashes := make([]MacroHash, count)
+	for i := range hashes {
+		hashes[i] = b.popMacroHash()
+	}
+	return hashes
+}
+
+// decodeMacroHashes reads the hash list following the stream header in a
+// handshake message.
+func decodeMacroHashes(message []byte) (hashes []MacroHash, err error) {
+	defer recoverDecodeError(&err)
+	b := NewBytecodeFromBytes(message[streamHeaderSize:])
+	hashes = b.popMacroHashes()
+	if b.i != len(b.bytes) {
+		b.error(errorOutOfRange, "trailing bytes after the macro hashes")
+	}
+	return hashes, nil
+}
+
+type libraryMacro struct {
+	definition []byte // operations between uopMacroStart and uopMacroEnd, fixed width
+	macro      *Macro
+}
+
+type MacroLibrary struct {
+	numberFormat NumberFormat
+	hashes       []MacroHash // in file order
+	macros       map[MacroHash]*libraryMacro
+}
+
+// BuildMacroLibrary returns a library file of the macros define adds with the
+// server's macro builder.
+func BuildMacroLibrary(numberFormat NumberFormat, define func(s *Server)) (file []byte, err error) {
+	defer recoverEncodeError(&err)
+	s := NewServer()
+	s.header = NewStreamHeader(numberFormat, 0)
+	s.Bytecode = *NewBytecode().applyHeader(s.header)
+	define(s)
+	b := NewBytecode()
+	b.pushBytes(libraryMagic)
+	b.pushUint16(libraryVersion)
+	b.pushUint8(uint8(numberFormat))
+	b.pushBytes(s.bytes)
+	return b.bytes, nil
+}
+
+// LoadMacroLibrary decodes and validates a library file.
+func LoadMacroLibrary(file []byte) (library *MacroLibrary, err error) {
+	b := NewBytecodeFromBytes(file)
+	if len(file) < len(libraryMagic)+3 || !bytes.Equal(b.popBytes(len(libraryMagic)), libraryMagic) {
+		return nil, fmt.Errorf("not a macro library")
+	}
+	if version := b.popUint16(); version != libraryVersion {
+		return nil, fmt.Errorf("unsupported macro library version %d", version)
+	}
+	library = &MacroLibrary{
+		numberFormat: NumberFormat(b.popUint8()),
+		macros:       map[MacroHash]*libraryMacro{},
+	}
+	if library.numberFormat >= numberFormatCount {
+		return nil, fmt.Errorf("unsupported number format %d", library.numberFormat)
+	}
+	// the client decodes the definitions, which checks them against the
+	// opcode tables
+	decoder := NewClient(nil)
+	decoder.header = NewStreamHeader(library.numberFormat, 0)
+	decoder.handshakeDone = true
+	defer recoverDecodeError(&err)
+	for b.i < len(b.bytes) {
+		start := b.i
+		if opcode := b.popOpcode(); opcode != uopMacroStart {
+			b.error(errorInvalidState, "LoadMacroLibrary: "+opcodeName(false, opcode)+" outside a macro definition")
+		}
+		macroNumber := b.popMacroNumber()
+		bodyStart := b.i
+		for {
+			opcode := b.popOpcode()
+			if opcode == uopMacroEnd {
+				break
+			}
+			switch opcode {
+			case uopMacroVar, uopMacroOperation, uopMacroUseVar, uopMacroUseConst:
+				b.skipOperands(updateOpcodes[opcode].operands, nil)
+			default:
+				b.error(errorInvalidState, "LoadMacroLibrary: "+opcodeName(false, opcode)+" in a macro definition")
+			}
+		}
+		if err := decoder.applyPayload(NewBytecodeFromBytes(file[start:b.i])); err != nil {
+			return nil, err
+		}
+		macro := decoder.macros[macroNumber]
+		if len(macro.calls) > 0 {
+			return nil, fmt.Errorf("library macro %d calls other macros", macroNumber)
+		}
+		definition := file[bodyStart : b.i-1]
+		hash := hashMacro(library.numberFormat, definition)
+		if _, ok := library.macros[hash]; !ok {
+			library.hashes = append(library.hashes, hash)
+			library.macros[hash] = &libraryMacro{definition: definition, macro: macro}
+		}
+	}
+	return library, nil
+}
+
+// Hashes returns the hashes of the library's macros in file order.
+func (l *MacroLibrary) Hashes() []MacroHash {
+	return l.hashes
+}
+
+// UseLibrary makes the macros of a library available to the server. Call it
+// before Offer.
+func (s *Server) UseLibrary(library *MacroLibrary) {
+	s.library = library
+}
+
+// LibraryMacro returns the number of a library macro in this session, valid
+// after Init.
+func (s *Server) LibraryMacro(hash MacroHash) (MacroNumber, bool) {
+	macroNumber, ok := s.libraryNumbers[hash]
+	return macroNumber, ok
+}
+
+// loadLibrary gives every library macro a number, sending the definitions of
+// those the client is missing.
+func (s *Server) loadLibrary() {
+	s.libraryNumbers = map[MacroHash]MacroNumber{}
+	if !s.header.HasFeature(featureLibrary) {
+		return
+	}
+	for _, hash := range s.library.hashes {
+		entry := s.library.macros[hash]
+		if s.libraryMissing[hash] {
+			s.libraryNumbers[hash] = s.macroStart()
+			s.replayDefinition(entry.definition)
+			s.macroEnd()
+			continue
+		}
+		macroNumber := s.newMacroNumber()
+		s.update(uopMacroLoad, macroNumber, hash)
+		s.macroVariables[macroNumber] = entry.macro.variableTypes
+		s.macroCalls[macroNumber] = nil
+		s.libraryNumbers[hash] = macroNumber
+	}
+}
+
+// replayDefinition builds a macro from the definition operations of a library
+// macro, re-encoding them for the stream.
+func (s *Server) replayDefinition(definition []byte) {
+	b := NewBytecodeFromBytes(definition)
+	b.numberFormat = s.library.numberFormat
+	for b.i < len(b.bytes) {
+		switch b.popOpcode() {
+		case uopMacroVar:
+			s.macroVar(OperandType(b.popUint8()))
+		case uopMacroOperation:
+			s.macroOperation(b.popUint8())
+		case uopMacroUseVar:
+			s.macroUseVar(b.popVariableNumber())
+		case uopMacroUseConst:
+			s.macroUseConst(b.popBytes(b.popSize()))
+		}
+	}
+}
+
+// UseLibrary makes the macros of a library available to the client. Call it
+// before Handshake.
+func (c *Client) UseLibrary(library *MacroLibrary) {
+	c.library = library
+}
+
+// missingLibraryMacros returns the offered hashes the client has no macro
+// for.
+func (c *Client) missingLibraryMacros(offered []MacroHash) []MacroHash {
+	missing := []MacroHash{}
+	for _, hash := range offered {
+		if c.library == nil || c.library.numberFormat != c.header.numberFormat || c.library.macros[hash] == nil {
+			missing = append(missing, hash)
+		}
+	}
+	return missing
+}
+
+// macroLoad defines a macro as a macro of the client's library.
+func (c *Client) macroLoad() {
+	if c.wipMacro != nil {
+		c.error(errorInvalidState, "macroLoad: inside a macro definition")
+	}
+	macroNumber := c.popMacroNumber()
+	hash := c.popMacroHash()
+	if c.library == nil || c.library.macros[hash] == nil {
+		c.error(errorUnknownMacro, fmt.Sprintf("macroLoad: library macro %x isn't loaded", hash))
+	}
+	// a copy, so redefining one number doesn't affect others bound to the
+	// same library macro
+	macro := *c.library.macros[hash].macro
+	c.installMacro(macroNumber, &macro)
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/goxjs/gl"
@@ -23,6 +25,44 @@ func key(w *glfw.Window, key glfw.Key, scancode int, action glfw.Action, mods gl
 }
 
 func main() {
+	benchmarkFrames := flag.Int("benchmark", 0, "stream this many update frames without a window and print their size")
+	recordPath := flag.String("record", "", "write the stream of the test scene to this file")
+	recordFrames := flag.Int("frames", 100, "number of update frames to -record")
+	disassemblePath := flag.String("disasm", "", "print a stream file as assembly")
+	assemblePath := flag.String("asm", "", "assemble a file and write the stream to stdout")
+	libraryPath := flag.String("library", "", "load a macro library file into the client and server")
+	writeLibraryPath := flag.String("write-library", "", "write a macro library of the test scene to this file")
+	flag.Parse()
+	if *benchmarkFrames > 0 {
+		runBenchmark(*benchmarkFrames)
+		return
+	}
+	if *recordPath != "" || *disassemblePath != "" || *assemblePath != "" || *writeLibraryPath != "" {
+		debug = false
+		var library *MacroLibrary
+		var err error
+		if *libraryPath != "" {
+			if library, err = loadLibraryFile(*libraryPath); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		switch {
+		case *recordPath != "":
+			err = recordStream(*recordPath, *recordFrames, library)
+		case *writeLibraryPath != "":
+			err = writeTestLibrary(*writeLibraryPath)
+		case *disassemblePath != "":
+			err = disassembleFile(*disassemblePath, library)
+		default:
+			err = assembleFile(*assemblePath)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	err := glfw.Init(gl.ContextWatcher)
 	if err != nil {
@@ -51,11 +91,31 @@ func main() {
 
 	client := NewClient(ctx)
 	server := NewServer()
+	if *libraryPath != "" {
+		library, err := loadLibraryFile(*libraryPath)
+		if err != nil {
+			panic(err)
+		}
+		client.UseLibrary(library)
+		server.UseLibrary(library)
+	}
 
-	funDefBytes := server.Init()
-	funDefBytecode := NewBytecodeFromBytes(funDefBytes)
-	fmt.Println(funDefBytecode)
-	client.Update(funDefBytecode)
+	answer, err := client.Handshake(server.Offer())
+	if err != nil {
+		panic(err)
+	}
+	if err := server.Accept(answer); err != nil {
+		panic(err)
+	}
+
+	funDefBytes, err := server.Init()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(funDefBytes)
+	if _, err := client.Update(funDefBytes); err != nil {
+		panic(err)
+	}
 	fmt.Println("init done")
 
 	for !window.ShouldClose() {
@@ -82,10 +142,23 @@ func main() {
 
 		fmt.Println("new update frame")
 
-		bytes := server.Update()
-		bytecode := NewBytecodeFromBytes(bytes)
-		client.Update(bytecode)
-		client.Render()
+		bytes, err := server.Update()
+		if err != nil {
+			fmt.Println("server update: ", err)
+		}
+		gaps, err := client.Update(bytes)
+		for _, gap := range gaps {
+			fmt.Println("frame gap: ", gap)
+		}
+		if err != nil {
+			fmt.Println("dropped frame: ", err, " dropped: ", client.droppedFrames, " corrupted: ", client.corruptedFrames)
+		}
+		if client.KeyFrameNeeded() {
+			server.RequestKeyFrame()
+		}
+		if err := client.Render(); err != nil {
+			fmt.Println("render error: ", err)
+		}
 
 		// ctx.BeginPath()
 		// ctx.MoveTo(176.02533164390738, 179.57979919208287)
@@ -0,0 +1,94 @@
+package main
+
+import "math"
+
+// NumberFormat selects how coordinates and other real numbers are encoded. The
+// server picks one per stream and declares it in the stream header.
+type NumberFormat uint8
+
+const (
+	numberFormatFixed16 NumberFormat = iota // int32 with 16 fractional bits, range ±32768
+	numberFormatFixed8                      // int32 with 8 fractional bits, range ±8388608
+	numberFormatFixed4                      // int32 with 4 fractional bits, range ±134217728
+	numberFormatFloat32
+	numberFormatFloat64
+
+	numberFormatCount
+)
+
+var numberFormatNames = [numberFormatCount]string{"fixed16", "fixed8", "fixed4", "float32", "float64"}
+
+var numberFormatFixpointBits = [numberFormatCount]uint{16, 8, 4, 0, 0}
+
+func (f NumberFormat) String() string {
+	if f >= numberFormatCount {
+		return "unknown"
+	}
+	return numberFormatNames[f]
+}
+
+func (f NumberFormat) isFixpoint() bool {
+	return f <= numberFormatFixed4
+}
+
+func (f NumberFormat) fixpointMultiplier() float64 {
+	return float64(int(1) << numberFormatFixpointBits[f])
+}
+
+// size is the number of bytes a number takes in fixed width encoding.
+func (f NumberFormat) size() int {
+	if f == numberFormatFloat64 {
+		return 8
+	}
+	return 4
+}
+
+func (f NumberFormat) sizeOfVec2() int {
+	return 2 * f.size()
+}
+
+func (f NumberFormat) sizeOfRect() int {
+	return 4 * f.size()
+}
+
+func (b *Bytecode) pushFloat64(value float64) {
+	format := b.numberFormat
+	switch {
+	case format.isFixpoint():
+		scaled := math.Round(value * format.fixpointMultiplier())
+		if math.IsNaN(scaled) || scaled <= math.MinInt32-1 || scaled >= math.MaxInt32+1 {
+			b.encodeError("pushFloat64: " + format.String() + " can't represent " + formatFloat(value))
+		}
+		if b.varint {
+			b.pushVarint(int64(int32(scaled)))
+		} else {
+			b.pushInt32(int32(scaled))
+		}
+	case format == numberFormatFloat32:
+		if math.Abs(value) > math.MaxFloat32 && !math.IsInf(value, 0) {
+			b.encodeError("pushFloat64: float32 can't represent " + formatFloat(value))
+		}
+		b.pushUint32(math.Float32bits(float32(value)))
+	default:
+		b.pushUint64(math.Float64bits(value))
+	}
+}
+
+func (b *Bytecode) popFloat64() float64 {
+	format := b.numberFormat
+	switch {
+	case format.isFixpoint():
+		if !b.varint {
+			return float64(b.popInt32()) / format.fixpointMultiplier()
+		}
+		fixpoint := b.popVarint()
+		if fixpoint < math.MinInt32 || fixpoint > math.MaxInt32 {
+			b.error(errorOutOfRange, "popFloat64 int32 overflow")
+		}
+		return float64(fixpoint) / format.fixpointMultiplier()
+	case format == numberFormatFloat32:
+		return float64(math.Float32frombits(b.popUint32()))
+	default:
+		return math.Float64frombits(b.popUint64())
+	}
+}
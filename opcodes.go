@@ -0,0 +1,535 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/shibukawa/nanovgo"
+)
+
+// render operations
+const (
+	ropBeginPath = iota
+	ropSetFillColor
+	ropFill
+	ropMoveTo
+	ropLineTo
+	ropClosePath
+
+	ropMacroCall
+
+	ropUseAnchor
+
+	// path ops relative to the current point, like lowercase SVG path commands.
+	// The delta forms carry int8 or int16 offsets in 1/pathDeltaMultiplier units.
+	ropMoveToRelative
+	ropLineToRelative
+	ropMoveToDelta8
+	ropLineToDelta8
+	ropMoveToDelta16
+	ropLineToDelta16
+
+	// an extended code and its operands with their length, see extended.go
+	ropExtended
+
+	// value stack operations, see expression.go
+	ropPushNumber
+	ropPushVec2
+	ropPushRgba
+	ropAdd
+	ropMultiply
+	ropNegate
+	ropMin
+	ropMax
+	ropSin
+	ropCos
+	ropApply
+
+	// control flow, see control.go
+	ropRepeat
+	ropIf
+	ropEnd
+	ropPushIndex
+
+	// strokes, see stroke.go
+	ropSetStrokeColor
+	ropSetStrokeWidth
+	ropSetLineCap
+	ropSetLineJoin
+	ropSetMiterLimit
+	ropSetStrokeScaling
+	ropStroke
+
+	// curves and shapes, see curves.go
+	ropBezierTo
+	ropQuadTo
+	ropArcTo
+	ropArc
+	ropEllipse
+	ropRect
+	ropRoundedRect
+
+	ropCodeCount
+)
+
+// update operations
+const (
+	uopMacroStart = iota
+	uopMacroEnd
+	uopMacroOperation
+	uopMacroVar
+	uopMacroUseVar
+	uopMacroUseConst
+
+	uopNodeCreate
+	uopNodeSetContent
+	uopNodeSetParent
+	uopNodeSetPosition
+	uopNodeSetRotation
+	uopNodeSetScale
+
+	uopAnchorCreate
+
+	uopNodeSetTransform
+	uopNodeSetPivot
+
+	// an extended code and its operands with their length, see extended.go
+	uopExtended
+
+	uopMacroDelete
+
+	uopNodeSetArgument
+
+	// a macro of the client's library, see library.go
+	uopMacroLoad
+
+	// opCreatePseudoNode
+
+	// opContextCreate
+
+	uopCodeCount
+)
+
+// OperandType is part of the protocol as the type of macro variables, new
+// types are only added at the end.
+type OperandType uint8
+
+const (
+	operandUint8 OperandType = iota
+	operandUint16
+	operandSize
+	operandNode
+	operandMacro
+	operandAnchor
+	operandVariable
+	operandNumber
+	operandVec2
+	operandRgba
+	operandRotation
+	operandScale
+	operandAffine
+	operandDelta8
+	operandDelta16
+	operandRenderOpcode
+	operandConst     // size and raw bytes of a macro constant
+	operandMacroArgs // variable block of the macro in the previous operand
+	operandExtendedCode
+	operandBlock        // length and operand bytes of an extended operation
+	operandVariableType // operand type of a macro variable
+	operandHash         // content hash of a library macro
+
+	operandTypeCount
+)
+
+var operandTypeNames = [operandTypeCount]string{
+	"uint8", "uint16", "size", "node", "macro", "anchor", "variable", "number", "vec2", "rgba", "rotation",
+	"scale", "affine", "delta8", "delta16", "rop", "const", "args", "extended", "block", "type",
+	"hash",
+}
+
+func (t OperandType) String() string {
+	return operandTypeNames[t]
+}
+
+// tokens is the number of text fields the operand takes.
+func (t OperandType) tokens() int {
+	switch t {
+	case operandVec2, operandScale, operandDelta8, operandDelta16:
+		return 2
+	case operandAffine:
+		return 6
+	}
+	return 1
+}
+
+// fixedSize is the size of the operand in render bytecode, or 0 if it
+// doesn't have a fixed size.
+func (t OperandType) fixedSize(format NumberFormat) int {
+	switch t {
+	case operandUint8, operandSize, operandRenderOpcode, operandVariableType:
+		return 1
+	case operandUint16, operandNode, operandMacro, operandAnchor, operandVariable, operandDelta8, operandExtendedCode:
+		return 2
+	case operandNumber:
+		return format.size()
+	case operandVec2, operandScale:
+		return format.sizeOfVec2()
+	case operandRgba, operandRotation, operandDelta16:
+		return 4
+	case operandAffine:
+		return 6 * format.size()
+	}
+	return 0
+}
+
+// isVariableType reports whether macro variables can have the type, values
+// that render operations take with a fixed size.
+func (t OperandType) isVariableType() bool {
+	switch t {
+	case operandUint8, operandUint16, operandMacro, operandAnchor, operandNumber, operandVec2, operandRgba,
+		operandRotation, operandScale, operandAffine, operandDelta8, operandDelta16:
+		return true
+	}
+	return false
+}
+
+// variablesSize is the size of the argument block for variables of the given
+// types.
+func variablesSize(types []OperandType, format NumberFormat) int {
+	size := 0
+	for _, variableType := range types {
+		size += variableType.fixedSize(format)
+	}
+	return size
+}
+
+func sameOperandTypes(a, b []OperandType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkMacroConst reports what is wrong with a constant given for an operand
+// in a macro body, where operands are fixed width.
+func checkMacroConst(operandType OperandType, constBytes []byte, format NumberFormat) error {
+	switch operandType {
+	case operandBlock:
+		if len(constBytes) < 2 || NewBytecodeFromBytes(constBytes).popBlockLength() != len(constBytes)-2 {
+			return fmt.Errorf("block constant of %d bytes doesn't match its length", len(constBytes))
+		}
+		return nil
+	case operandRenderOpcode:
+		if len(constBytes) != 1 || constBytes[0] >= ropCodeCount {
+			return fmt.Errorf("invalid render opcode constant %x", constBytes)
+		}
+		if blockOpcode(constBytes[0]) {
+			return fmt.Errorf("%s can't be applied", renderOpcodes[constBytes[0]].name)
+		}
+		for _, applied := range renderOpcodes[constBytes[0]].operands {
+			if stackValueCount(applied) == 0 {
+				return fmt.Errorf("%s takes a %s operand, which isn't on the value stack", renderOpcodes[constBytes[0]].name, applied)
+			}
+		}
+		return nil
+	}
+	if size := operandType.fixedSize(format); len(constBytes) != size {
+		return fmt.Errorf("%s operand takes %d bytes, %d given", operandType, size, len(constBytes))
+	}
+	return nil
+}
+
+// Opcode describes an operation in the stream: its name and the operands that
+// follow the opcode byte. The tables below are the one place opcodes are
+// described; the Client checks it has a handler for every entry, the Server
+// encodes its operations against them and the assembler and disassembler are
+// driven by them.
+type Opcode struct {
+	name     string
+	operands []OperandType
+}
+
+var updateOpcodes = [uopCodeCount]Opcode{
+	uopMacroStart:       {"uopMacroStart", []OperandType{operandMacro}},
+	uopMacroEnd:         {"uopMacroEnd", []OperandType{}},
+	uopMacroOperation:   {"uopMacroOperation", []OperandType{operandRenderOpcode}},
+	uopMacroVar:         {"uopMacroVar", []OperandType{operandVariableType}},
+	uopMacroUseVar:      {"uopMacroUseVar", []OperandType{operandVariable}},
+	uopMacroUseConst:    {"uopMacroUseConst", []OperandType{operandConst}},
+	uopNodeCreate:       {"uopNodeCreate", []OperandType{operandNode}},
+	uopNodeSetContent:   {"uopNodeSetContent", []OperandType{operandNode, operandMacro, operandMacroArgs}},
+	uopNodeSetParent:    {"uopNodeSetParent", []OperandType{operandNode, operandNode}},
+	uopNodeSetPosition:  {"uopNodeSetPosition", []OperandType{operandNode, operandVec2}},
+	uopNodeSetRotation:  {"uopNodeSetRotation", []OperandType{operandNode, operandRotation}},
+	uopNodeSetScale:     {"uopNodeSetScale", []OperandType{operandNode, operandScale}},
+	uopAnchorCreate:     {"uopAnchorCreate", []OperandType{operandAnchor, operandNode, operandVec2}},
+	uopNodeSetTransform: {"uopNodeSetTransform", []OperandType{operandNode, operandAffine}},
+	uopNodeSetPivot:     {"uopNodeSetPivot", []OperandType{operandNode, operandVec2}},
+	uopExtended:         {"uopExtended", []OperandType{operandExtendedCode, operandBlock}},
+	uopMacroDelete:      {"uopMacroDelete", []OperandType{operandMacro}},
+	uopNodeSetArgument:  {"uopNodeSetArgument", []OperandType{operandNode, operandVariable, operandConst}},
+	uopMacroLoad:        {"uopMacroLoad", []OperandType{operandMacro, operandHash}},
+}
+
+var renderOpcodes = [ropCodeCount]Opcode{
+	ropBeginPath:        {"ropBeginPath", []OperandType{}},
+	ropSetFillColor:     {"ropSetFillColor", []OperandType{operandRgba}},
+	ropFill:             {"ropFill", []OperandType{}},
+	ropMoveTo:           {"ropMoveTo", []OperandType{operandVec2}},
+	ropLineTo:           {"ropLineTo", []OperandType{operandVec2}},
+	ropClosePath:        {"ropClosePath", []OperandType{}},
+	ropMacroCall:        {"ropMacroCall", []OperandType{operandMacro, operandMacroArgs}},
+	ropUseAnchor:        {"ropUseAnchor", []OperandType{operandAnchor}},
+	ropMoveToRelative:   {"ropMoveToRelative", []OperandType{operandVec2}},
+	ropLineToRelative:   {"ropLineToRelative", []OperandType{operandVec2}},
+	ropMoveToDelta8:     {"ropMoveToDelta8", []OperandType{operandDelta8}},
+	ropLineToDelta8:     {"ropLineToDelta8", []OperandType{operandDelta8}},
+	ropMoveToDelta16:    {"ropMoveToDelta16", []OperandType{operandDelta16}},
+	ropLineToDelta16:    {"ropLineToDelta16", []OperandType{operandDelta16}},
+	ropExtended:         {"ropExtended", []OperandType{operandExtendedCode, operandBlock}},
+	ropPushNumber:       {"ropPushNumber", []OperandType{operandNumber}},
+	ropPushVec2:         {"ropPushVec2", []OperandType{operandVec2}},
+	ropPushRgba:         {"ropPushRgba", []OperandType{operandRgba}},
+	ropAdd:              {"ropAdd", []OperandType{}},
+	ropMultiply:         {"ropMultiply", []OperandType{}},
+	ropNegate:           {"ropNegate", []OperandType{}},
+	ropMin:              {"ropMin", []OperandType{}},
+	ropMax:              {"ropMax", []OperandType{}},
+	ropSin:              {"ropSin", []OperandType{}},
+	ropCos:              {"ropCos", []OperandType{}},
+	ropApply:            {"ropApply", []OperandType{operandRenderOpcode}},
+	ropRepeat:           {"ropRepeat", []OperandType{operandUint16}},
+	ropIf:               {"ropIf", []OperandType{}},
+	ropEnd:              {"ropEnd", []OperandType{}},
+	ropPushIndex:        {"ropPushIndex", []OperandType{}},
+	ropSetStrokeColor:   {"ropSetStrokeColor", []OperandType{operandRgba}},
+	ropSetStrokeWidth:   {"ropSetStrokeWidth", []OperandType{operandNumber}},
+	ropSetLineCap:       {"ropSetLineCap", []OperandType{operandUint8}},
+	ropSetLineJoin:      {"ropSetLineJoin", []OperandType{operandUint8}},
+	ropSetMiterLimit:    {"ropSetMiterLimit", []OperandType{operandNumber}},
+	ropSetStrokeScaling: {"ropSetStrokeScaling", []OperandType{operandUint8}},
+	ropStroke:           {"ropStroke", []OperandType{}},
+	ropBezierTo:         {"ropBezierTo", []OperandType{operandVec2, operandVec2, operandVec2}},
+	ropQuadTo:           {"ropQuadTo", []OperandType{operandVec2, operandVec2}},
+	ropArcTo:            {"ropArcTo", []OperandType{operandVec2, operandVec2, operandNumber}},
+	ropArc:              {"ropArc", []OperandType{operandVec2, operandNumber, operandNumber, operandNumber}},
+	ropEllipse:          {"ropEllipse", []OperandType{operandVec2, operandVec2}},
+	ropRect:             {"ropRect", []OperandType{operandVec2, operandVec2}},
+	ropRoundedRect:      {"ropRoundedRect", []OperandType{operandVec2, operandVec2, operandNumber}},
+}
+
+func init() {
+	checkOpcodes(updateOpcodes[:])
+	checkOpcodes(renderOpcodes[:])
+}
+
+// checkOpcodes makes sure every opcode up to the code count is described and
+// no two share a name, so a new opcode can't be added to one place only.
+func checkOpcodes(opcodes []Opcode) {
+	names := map[string]bool{}
+	for opcode, description := range opcodes {
+		if description.name == "" || description.operands == nil {
+			panic(fmt.Sprint("opcode ", opcode, " has no description"))
+		}
+		if names[description.name] {
+			panic("duplicate opcode name " + description.name)
+		}
+		names[description.name] = true
+	}
+}
+
+func lookupOpcode(opcodes []Opcode, name string) (uint8, bool) {
+	for opcode, description := range opcodes {
+		if description.name == name {
+			return uint8(opcode), true
+		}
+	}
+	return 0, false
+}
+
+func opcodeName(render bool, opcode uint8) string {
+	if render && opcode < ropCodeCount {
+		return renderOpcodes[opcode].name
+	} else if !render && opcode < uopCodeCount {
+		return updateOpcodes[opcode].name
+	}
+	return fmt.Sprint("opcode ", opcode)
+}
+
+// pushOperation writes an opcode and its operands as described in opcodes.
+// Operands are given as the Go type their push method takes, []byte for
+// constants and macro arguments.
+func (b *Bytecode) pushOperation(opcodes []Opcode, opcode uint8, operands ...interface{}) {
+	b.pushOpcode(opcode)
+	b.pushOperands(opcodes[opcode], operands...)
+}
+
+func (b *Bytecode) pushOperands(description Opcode, operands ...interface{}) {
+	if len(operands) != len(description.operands) {
+		b.encodeError(fmt.Sprint(description.name, ": ", len(operands), " operands given, expected ", len(description.operands)))
+	}
+	for i, operandType := range description.operands {
+		if !b.pushOperand(operandType, operands[i]) {
+			b.encodeError(fmt.Sprintf("%s: operand %d is %T, expected %s", description.name, i, operands[i], operandType))
+		}
+	}
+}
+
+// pushOperand writes a single operand and reports false if the value has the
+// wrong type for it.
+func (b *Bytecode) pushOperand(operandType OperandType, operand interface{}) bool {
+	switch value := operand.(type) {
+	case uint8:
+		switch operandType {
+		case operandUint8, operandRenderOpcode:
+			b.pushUint8(value)
+			return true
+		}
+	case uint16:
+		switch operandType {
+		case operandUint16:
+			b.pushUint16(value)
+			return true
+		case operandVariable:
+			b.pushVariableNumber(value)
+			return true
+		}
+	case int:
+		if operandType == operandSize {
+			b.pushSize(value)
+			return true
+		}
+	case NodeNumber:
+		if operandType == operandNode {
+			b.pushNodeNumber(value)
+			return true
+		}
+	case MacroNumber:
+		if operandType == operandMacro {
+			b.pushMacroNumber(value)
+			return true
+		}
+	case AnchorNumber:
+		if operandType == operandAnchor {
+			b.pushAnchorNumber(value)
+			return true
+		}
+	case OperandType:
+		if operandType == operandVariableType {
+			b.pushUint8(uint8(value))
+			return true
+		}
+	case ExtendedCode:
+		if operandType == operandExtendedCode {
+			b.pushExtendedCode(value)
+			return true
+		}
+	case MacroHash:
+		if operandType == operandHash {
+			b.pushMacroHash(value)
+			return true
+		}
+	case float64:
+		switch operandType {
+		case operandNumber:
+			b.pushFloat64(value)
+			return true
+		case operandRotation:
+			b.pushRotation(value)
+			return true
+		}
+	case Vec2:
+		switch operandType {
+		case operandVec2:
+			b.pushVec2(value)
+			return true
+		case operandScale:
+			b.pushScale(value)
+			return true
+		case operandDelta8:
+			b.pushDelta8(value)
+			return true
+		case operandDelta16:
+			b.pushDelta16(value)
+			return true
+		}
+	case nanovgo.Color:
+		if operandType == operandRgba {
+			b.pushRgba(value)
+			return true
+		}
+	case Matrix33:
+		if operandType == operandAffine {
+			b.pushAffine(value)
+			return true
+		}
+	case []byte:
+		switch operandType {
+		case operandConst:
+			b.pushSize(len(value))
+			b.pushBytes(value)
+			return true
+		case operandMacroArgs:
+			b.pushBytes(value)
+			return true
+		case operandBlock:
+			b.pushBlockLength(len(value))
+			b.pushBytes(value)
+			return true
+		}
+	}
+	return false
+}
+
+// skipOperands reads past the operands of an operation and returns the offset
+// after them. macroArgsSize gives the variable block size of a macro.
+func (b *Bytecode) skipOperands(operands []OperandType, macroArgsSize func(MacroNumber) int) int {
+	var macroNumber MacroNumber
+	for _, operandType := range operands {
+		switch operandType {
+		case operandUint8, operandRenderOpcode, operandVariableType:
+			b.popUint8()
+		case operandUint16:
+			b.popUint16()
+		case operandSize:
+			b.popSize()
+		case operandNode:
+			b.popNodeNumber()
+		case operandMacro:
+			macroNumber = b.popMacroNumber()
+		case operandAnchor:
+			b.popAnchorNumber()
+		case operandVariable:
+			b.popVariableNumber()
+		case operandNumber:
+			b.popFloat64()
+		case operandVec2, operandScale:
+			b.popVec2()
+		case operandRgba:
+			b.popRgba()
+		case operandRotation:
+			b.popRotation()
+		case operandAffine:
+			b.popAffine()
+		case operandDelta8:
+			b.popDelta8()
+		case operandDelta16:
+			b.popDelta16()
+		case operandConst:
+			b.popBytes(b.popSize())
+		case operandMacroArgs:
+			b.popBytes(macroArgsSize(macroNumber))
+		case operandExtendedCode:
+			b.popExtendedCode()
+		case operandBlock:
+			b.skip(b.popBlockLength())
+		case operandHash:
+			b.popMacroHash()
+		}
+	}
+	return b.i
+}
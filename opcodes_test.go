@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestCheckMacroConstApplyTargets(t *testing.T) {
+	tests := []struct {
+		opcode uint8
+		valid  bool
+	}{
+		{ropLineTo, true},
+		{ropSetFillColor, true},
+		{ropRepeat, false},
+		{ropIf, false},
+		{ropEnd, false},
+		{ropPushIndex, false},
+		{ropMacroCall, false},
+		{ropCodeCount, false},
+	}
+	for _, test := range tests {
+		err := checkMacroConst(operandRenderOpcode, []byte{test.opcode}, numberFormatFloat32)
+		if (err == nil) != test.valid {
+			t.Errorf("opcode %d: error %v, want valid %v", test.opcode, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import "fmt"
+
+// Applications add their own operations, like instrument gauges, as extended
+// operations registered under a namespace of their own. Namespace 0 is kept
+// for extended operations of the protocol itself. The registry is part of this
+// program, not a library: an extension is a file added to the package whose
+// init function registers its operations, without changes to the opcode
+// tables, the client or the server. Registration panics on a collision, for
+// example:
+//
+//	var gaugeNeedle = RegisterRenderOperation(1, 0, "gauge.needle",
+//		[]OperandType{operandNumber}, func(c *Client, n *Node) {
+//			drawNeedle(c.nvgCtx, n, c.popFloat64())
+//		})
+//
+// and on the server, inside a macro definition:
+//
+//	s.MacroExtended(gaugeNeedle, 0.75)
+//
+// Clients created after registration decode the operation, older ones skip it.
+
+const builtinNamespace = 0
+
+type extendedOperation struct {
+	Opcode
+	update func(*Client)
+	render func(*Client, *Node)
+}
+
+var extendedUpdateRegistry = map[ExtendedCode]*extendedOperation{}
+var extendedRenderRegistry = map[ExtendedCode]*extendedOperation{}
+
+func NewExtendedCode(namespace uint8, code uint8) ExtendedCode {
+	return ExtendedCode(namespace)<<8 | ExtendedCode(code)
+}
+
+func (c ExtendedCode) Namespace() uint8 {
+	return uint8(c >> 8)
+}
+
+// RegisterUpdateOperation adds an extended update operation. decode reads the
+// operands from the client and applies them; it has to record how to undo
+// changes to the client state with Client.record.
+func RegisterUpdateOperation(namespace uint8, code uint8, name string, operands []OperandType, decode func(c *Client)) ExtendedCode {
+	return registerExtended(extendedUpdateRegistry, namespace, code, &extendedOperation{
+		Opcode: Opcode{name, operands},
+		update: decode,
+	})
+}
+
+// RegisterRenderOperation adds an extended render operation. decode reads the
+// operands from the client and draws them for the node.
+func RegisterRenderOperation(namespace uint8, code uint8, name string, operands []OperandType, decode func(c *Client, n *Node)) ExtendedCode {
+	return registerExtended(extendedRenderRegistry, namespace, code, &extendedOperation{
+		Opcode: Opcode{name, operands},
+		render: decode,
+	})
+}
+
+func registerExtended(registry map[ExtendedCode]*extendedOperation, namespace uint8, code uint8, operation *extendedOperation) ExtendedCode {
+	if namespace == builtinNamespace {
+		panic("extended operation " + operation.name + " registered in the built in namespace")
+	}
+	extendedCode := NewExtendedCode(namespace, code)
+	if existing, ok := registry[extendedCode]; ok {
+		panic(fmt.Sprint("extended operation ", operation.name, " registered with the code of ", existing.name, ": ", namespace, ".", code))
+	}
+	if _, ok := lookupExtended(operation.name); ok {
+		panic("duplicate extended operation name " + operation.name)
+	}
+	registry[extendedCode] = operation
+	return extendedCode
+}
+
+func lookupExtended(name string) (*extendedOperation, bool) {
+	for _, registry := range [2]map[ExtendedCode]*extendedOperation{extendedUpdateRegistry, extendedRenderRegistry} {
+		for _, operation := range registry {
+			if operation.name == name {
+				return operation, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// installExtensions gives a new client the registered operations.
+func (c *Client) installExtensions() {
+	for code, operation := range extendedUpdateRegistry {
+		decode := operation.update
+		c.extendedUpdateOperations[code] = func() { decode(c) }
+	}
+	for code, operation := range extendedRenderRegistry {
+		decode := operation.render
+		c.extendedRenderOperations[code] = func(n *Node) { decode(c, n) }
+	}
+}
+
+// Extended writes a registered extended update operation.
+func (s *Server) Extended(code ExtendedCode, operands ...interface{}) {
+	operation, ok := extendedUpdateRegistry[code]
+	if !ok {
+		s.encodeError(fmt.Sprint("Extended: unregistered update operation ", code))
+	}
+	s.extended(code, func(b *Bytecode) {
+		b.pushOperands(operation.Opcode, operands...)
+	})
+}
+
+// MacroExtended adds a registered extended render operation with constant
+// operands to the macro being defined.
+func (s *Server) MacroExtended(code ExtendedCode, operands ...interface{}) {
+	operation, ok := extendedRenderRegistry[code]
+	if !ok {
+		s.encodeError(fmt.Sprint("MacroExtended: unregistered render operation ", code))
+	}
+	block := s.newConstBytecode()
+	block.pushOperands(operation.Opcode, operands...)
+	s.macroOperation(ropExtended)
+	constBytecode := s.newConstBytecode()
+	constBytecode.pushExtendedCode(code)
+	s.macroUseConst(constBytecode.bytes)
+	constBytecode = s.newConstBytecode()
+	constBytecode.pushBlockLength(len(block.bytes))
+	constBytecode.pushBytes(block.bytes)
+	s.macroUseConst(constBytecode.bytes)
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+// panics reports whether f panics.
+func panics(f func()) (panicked bool) {
+	defer func() {
+		if recover() != nil {
+			panicked = true
+		}
+	}()
+	f()
+	return false
+}
+
+func TestExtendedRegistry(t *testing.T) {
+	var counted []float64
+	var needles []Vec2
+	counter := RegisterUpdateOperation(7, 1, "test.counter", []OperandType{operandNumber}, func(c *Client) {
+		counted = append(counted, c.popFloat64())
+	})
+	needle := RegisterRenderOperation(7, 1, "test.needle", []OperandType{operandVec2}, func(c *Client, n *Node) {
+		needles = append(needles, c.popVec2())
+	})
+	defer func() {
+		delete(extendedUpdateRegistry, counter)
+		delete(extendedRenderRegistry, needle)
+	}()
+	// update and render codes are separate
+	if counter != NewExtendedCode(7, 1) || needle != counter || counter.Namespace() != 7 {
+		t.Fatalf("codes %#x and %#x, want %#x", counter, needle, NewExtendedCode(7, 1))
+	}
+	if operation, ok := lookupExtended("test.needle"); !ok || operation.render == nil {
+		t.Fatal("test.needle isn't found by name")
+	}
+
+	for name, register := range map[string]func(){
+		"same code":          func() { RegisterUpdateOperation(7, 1, "test.other", nil, func(c *Client) {}) },
+		"same name":          func() { RegisterRenderOperation(7, 2, "test.counter", nil, func(c *Client, n *Node) {}) },
+		"built in namespace": func() { RegisterUpdateOperation(builtinNamespace, 3, "test.builtin", nil, func(c *Client) {}) },
+	} {
+		if !panics(register) {
+			t.Fatalf("registration with %s didn't panic", name)
+		}
+	}
+	if len(extendedUpdateRegistry) != 1 || len(extendedRenderRegistry) != 1 {
+		t.Fatal("a colliding registration was added")
+	}
+
+	// clients created after registration decode the operations
+	server, client := newTestSession(t)
+	var node NodeNumber
+	sendFrame(t, server, client, func() {
+		server.Extended(counter, 2.5)
+		macroNumber := server.macroStart()
+		server.MacroExtended(needle, Vec2{3, 4})
+		server.macroEnd()
+		node = server.nodeCreate()
+		server.nodeSetContent(node, macroNumber)
+	})
+	renderTestNode(t, client, node)
+	if len(counted) != 1 || counted[0] != 2.5 || len(needles) != 1 || needles[0] != (Vec2{3, 4}) {
+		t.Fatalf("decoded %v and %v, want [2.5] and [{3 4}]", counted, needles)
+	}
+	if len(client.warnings) != 0 {
+		t.Fatalf("warnings %v", client.warnings)
+	}
+}
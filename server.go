@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"math"
 	"time"
 
@@ -12,8 +16,7 @@ var colorRed = nanovgo.Color{R: 1, G: 0, B: 0, A: 1}
 var colorGreen = nanovgo.Color{R: 0, G: 1, B: 0, A: 1}
 var colorBlue = nanovgo.Color{R: 0, G: 0, B: 1, A: 1}
 
-var testMacro1 MacroNumber
-var testMacro2 MacroNumber
+var testMacro MacroNumber
 var testNode1 NodeNumber
 var testNode2 NodeNumber
 
@@ -22,8 +25,35 @@ type Server struct {
 
 	startTime time.Time
 
-	macroVariableCount uint16
-	macroCount         uint16
+	features      uint32
+	numberFormat  NumberFormat
+	offer         StreamHeader
+	header        StreamHeader
+	handshakeDone bool
+	sequence      uint32
+
+	macroVariables    map[MacroNumber][]OperandType // variable types of every defined macro
+	macroCalls        map[MacroNumber][]MacroNumber // macros called by every defined macro
+	macroCallers      map[MacroNumber]int           // calls of a macro by defined macros
+	macroNodes        map[MacroNumber]int           // nodes showing every macro
+	macroReleased     map[MacroNumber]bool          // macros deleted once nothing uses them
+	nodeContents      map[NodeNumber]MacroNumber
+	library           *MacroLibrary
+	libraryMissing    map[MacroHash]bool // library macros the client doesn't have
+	libraryNumbers    map[MacroHash]MacroNumber
+	wipMacroNumber    MacroNumber
+	wipVariables      []OperandType
+	wipCalls          []MacroNumber
+	macroPending      []OperandType // operands of the last macro operation still to be given
+	macroOpcode       uint8         // the last macro operation
+	macroBlocks       int           // open repeat and if blocks of the macro being defined
+	macroCount        uint16
+	freeMacros        []MacroNumber // numbers of deleted macros, given out again before new ones
+	macroPathPoint    Vec2
+	macroSubpathStart Vec2
+	macroPathStarted  bool
+	macroPathKnown    bool // the path fields above match the client's, so points can be sent as deltas
+	dictionary        compressionDictionary
 
 	nodeCount uint16
 
@@ -35,6 +65,13 @@ type Server struct {
 func NewServer() *Server {
 	var server Server = Server{
 		Bytecode:       *NewBytecode(),
+		features:       supportedFeatures,
+		macroVariables: map[MacroNumber][]OperandType{},
+		macroCalls:     map[MacroNumber][]MacroNumber{},
+		macroCallers:   map[MacroNumber]int{},
+		macroNodes:     map[MacroNumber]int{},
+		macroReleased:  map[MacroNumber]bool{},
+		nodeContents:   map[NodeNumber]MacroNumber{},
 		rect:           Rect{Vec2{0, 0}, Vec2{30, 30}},
 		rectDirectionX: 1,
 		rectDirectionY: 1,
@@ -42,21 +79,110 @@ func NewServer() *Server {
 	return &server
 }
 
-func (s *Server) Init() []byte {
-	s.Bytecode = *NewBytecode()
+// Offer returns the stream header with the server's number format and all
+// features it is willing to use. It is the first thing written to a stream.
+func (s *Server) Offer() []byte {
+	features := s.features
+	if s.library == nil || s.library.numberFormat != s.numberFormat {
+		features &^= featureLibrary
+	}
+	s.offer = NewStreamHeader(s.numberFormat, features)
+	offer := NewBytecodeFromBytes(EncodeStreamHeader(s.offer))
+	if s.offer.HasFeature(featureLibrary) {
+		offer.pushMacroHashes(s.library.hashes)
+	}
+	return offer.bytes
+}
+
+// Accept takes the client's answer to Offer and fixes the features used for the
+// rest of the stream.
+func (s *Server) Accept(answer []byte) error {
+	header, err := DecodeStreamHeader(answer)
+	if err != nil {
+		return err
+	}
+	if header.numberFormat != s.offer.numberFormat {
+		return fmt.Errorf("client answered with number format %s, offered %s", header.numberFormat, s.offer.numberFormat)
+	}
+	if header.features&^s.offer.features != 0 {
+		return fmt.Errorf("client accepted features %#x that were not offered", header.features&^s.offer.features)
+	}
+	s.libraryMissing = map[MacroHash]bool{}
+	if header.HasFeature(featureLibrary) {
+		missing, err := decodeMacroHashes(answer)
+		if err != nil {
+			return err
+		}
+		for _, hash := range missing {
+			s.libraryMissing[hash] = true
+		}
+	}
+	s.header = header
+	s.handshakeDone = true
+	return nil
+}
+
+// Init returns the frame defining the scene. Values that can't be represented
+// in the stream's number format are returned as an EncodeError.
+func (s *Server) Init() ([]byte, error) {
+	if err := s.buildInit(); err != nil {
+		return nil, err
+	}
+	return s.frame(), nil
+}
+
+// WriteInit writes the frame defining the scene to w.
+func (s *Server) WriteInit(w io.Writer) error {
+	if err := s.buildInit(); err != nil {
+		return err
+	}
+	return s.writeFrame(w)
+}
+
+func (s *Server) buildInit() error {
+	if !s.handshakeDone {
+		return errors.New("Init before handshake")
+	}
+	return s.build(s.initScene)
+}
+
+func (s *Server) initScene() {
 	s.startTime = time.Now()
-	testMacro1 = s.defineTestMacro(colorRed)
-	testMacro2 = s.defineTestMacro(colorGreen)
-	testNode1 = s.createTestNode(testMacro1, s.rect.size)
-	testNode2 = s.createTestNode(testMacro2, Vec2{20, 40})
+	s.loadLibrary()
+	// the handshake binds the test macro if the client has it in its library
+	var ok bool
+	if testMacro, ok = s.libraryTestMacro(); !ok {
+		testMacro = s.defineTestMacro()
+	}
+	testNode1 = s.createTestNode(testMacro, colorRed)
+	testNode2 = s.createTestNode(testMacro, colorGreen)
+	s.nodeSetPivot(testNode1, Vec2{50, 50})
 	s.nodeSetParent(testNode2, testNode1)
 	s.nodeSetPosition(testNode2, Vec2{40, 40})
-	return s.bytes
 }
 
-func (s *Server) Update() []byte {
-	s.Bytecode = *NewBytecode()
+// Update returns the frame with this tick's changes. A frame that fails to
+// encode is dropped and doesn't use up a sequence number.
+func (s *Server) Update() ([]byte, error) {
+	if err := s.buildUpdate(); err != nil {
+		return nil, err
+	}
+	return s.frame(), nil
+}
+
+// WriteUpdate writes the frame with this tick's changes to w.
+func (s *Server) WriteUpdate(w io.Writer) error {
+	if err := s.buildUpdate(); err != nil {
+		return err
+	}
+	return s.writeFrame(w)
+}
 
+func (s *Server) buildUpdate() error {
+	return s.build(s.updateScene)
+}
+
+func (s *Server) updateScene() {
 	if s.rect.position.X > windowWidth {
 		s.rect.position.X = windowWidth
 		s.rectDirectionX = -1
@@ -96,46 +222,235 @@ func (s *Server) Update() []byte {
 	// xOffset := sinTime * 70
 	s.nodeSetPosition(testNode2, Vec2{20, 20})
 	// s.nodeSetPosition(testNode2, Vec2{xOffset, 0})
+}
 
-	return s.bytes
+// serverState is the bookkeeping of what the client has been sent, which the
+// operations of a frame change as they are written.
+type serverState struct {
+	nodeCount      uint16
+	macroCount     uint16
+	freeMacros     []MacroNumber
+	macroVariables map[MacroNumber][]OperandType
+	macroCalls     map[MacroNumber][]MacroNumber
+	macroCallers   map[MacroNumber]int
+	macroNodes     map[MacroNumber]int
+	macroReleased  map[MacroNumber]bool
+	nodeContents   map[NodeNumber]MacroNumber
+	libraryNumbers map[MacroHash]MacroNumber
 }
 
-func (s *Server) defineTestMacro(color nanovgo.Color) MacroNumber {
-	macroNumber := s.macroStart()
-	// sizeVar := s.macroVar(sizeOfVec2)
+func (s *Server) saveState() serverState {
+	state := serverState{
+		nodeCount:      s.nodeCount,
+		macroCount:     s.macroCount,
+		freeMacros:     append([]MacroNumber{}, s.freeMacros...),
+		macroVariables: map[MacroNumber][]OperandType{},
+		macroCalls:     map[MacroNumber][]MacroNumber{},
+		macroCallers:   map[MacroNumber]int{},
+		macroNodes:     map[MacroNumber]int{},
+		macroReleased:  map[MacroNumber]bool{},
+		nodeContents:   map[NodeNumber]MacroNumber{},
+		libraryNumbers: s.libraryNumbers,
+	}
+	// the maps are changed in place, their slices are replaced
+	for macroNumber, variables := range s.macroVariables {
+		state.macroVariables[macroNumber] = variables
+	}
+	for macroNumber, calls := range s.macroCalls {
+		state.macroCalls[macroNumber] = calls
+	}
+	for macroNumber, callers := range s.macroCallers {
+		state.macroCallers[macroNumber] = callers
+	}
+	for macroNumber, nodes := range s.macroNodes {
+		state.macroNodes[macroNumber] = nodes
+	}
+	for macroNumber := range s.macroReleased {
+		state.macroReleased[macroNumber] = true
+	}
+	for nodeNumber, macroNumber := range s.nodeContents {
+		state.nodeContents[nodeNumber] = macroNumber
+	}
+	return state
+}
 
-	s.macroOperation(ropBeginPath)
-	s.macroOperation(ropMoveTo)
-	s.macroUseConstVec2(Vec2{0, 0})
-	s.macroOperation(ropLineTo)
-	s.macroUseConstVec2(Vec2{100, 0})
-	s.macroOperation(ropLineTo)
-	s.macroUseConstVec2(Vec2{100, 100})
-	s.macroOperation(ropLineTo)
-	s.macroUseConstVec2(Vec2{0, 100})
-	s.macroOperation(ropClosePath)
+func (s *Server) restoreState(state serverState) {
+	s.nodeCount = state.nodeCount
+	s.macroCount = state.macroCount
+	s.freeMacros = state.freeMacros
+	s.macroVariables = state.macroVariables
+	s.macroCalls = state.macroCalls
+	s.macroCallers = state.macroCallers
+	s.macroNodes = state.macroNodes
+	s.macroReleased = state.macroReleased
+	s.nodeContents = state.nodeContents
+	s.libraryNumbers = state.libraryNumbers
+}
+
+// build writes the operations of the next frame. If they fail to encode, the
+// frame is dropped and the bookkeeping is rolled back, so the server keeps
+// matching the client, which never sees the frame.
+func (s *Server) build(operations func()) (err error) {
+	state := s.saveState()
+	defer func() {
+		if err != nil {
+			s.restoreState(state)
+		}
+	}()
+	defer recoverEncodeError(&err)
+	s.Bytecode = *NewBytecode().applyHeader(s.header)
+	s.dictionary.definitions = nil
+	operations()
+	return nil
+}
+
+// RequestKeyFrame makes the next compressed frame a key frame, for a client
+// whose KeyFrameNeeded reports a lost frame.
+func (s *Server) RequestKeyFrame() {
+	s.dictionary.keyRequested = true
+}
+
+// frame wraps the operations written since the last frame into a frame with
+// the next sequence number.
+func (s *Server) frame() []byte {
+	var framed bytes.Buffer
+	s.writeFrame(&framed)
+	return framed.Bytes()
+}
+
+// writeFrame writes the frame header and then the operations, without copying
+// them into one buffer.
+func (s *Server) writeFrame(w io.Writer) error {
+	frame := Frame{
+		sequence:  s.sequence,
+		timestamp: uint32(time.Since(s.startTime).Milliseconds()),
+		payload:   s.bytes,
+	}
+	if s.header.HasFeature(featureCompression) {
+		frame.payload = s.dictionary.compress(frame.sequence, s.bytes)
+		s.dictionary.commit(frame.sequence, s.bytes)
+	}
+	s.sequence++
+	header := NewBytecode().applyHeader(s.header)
+	header.pushFrameHeader(len(frame.payload), frame)
+	if _, err := w.Write(header.bytes); err != nil {
+		return err
+	}
+	if _, err := w.Write(frame.payload); err != nil {
+		return err
+	}
+	if !s.header.HasFeature(featureChecksum) {
+		return nil
+	}
+	trailer := NewBytecode()
+	trailer.pushUint32(frameChecksum(header.bytes, frame.payload))
+	_, err := w.Write(trailer.bytes)
+	return err
+}
+
+// libraryTestMacro returns the number loadLibrary gave the test macro, if the
+// library has it.
+func (s *Server) libraryTestMacro() (MacroNumber, bool) {
+	if s.library == nil {
+		return 0, false
+	}
+	file, err := BuildMacroLibrary(s.library.numberFormat, func(s *Server) {
+		s.defineTestMacro()
+	})
+	if err != nil {
+		return 0, false
+	}
+	library, err := LoadMacroLibrary(file)
+	if err != nil {
+		return 0, false
+	}
+	return s.LibraryMacro(library.hashes[0])
+}
+
+func (s *Server) defineTestMacro() MacroNumber {
+	macroNumber := s.macroStart()
+	colorVar := s.macroVar(operandRgba)
+
+	s.macroBeginPath()
+	s.macroMoveTo(Vec2{0, 0})
+	s.macroLineTo(Vec2{100, 0})
+	s.macroLineTo(Vec2{100, 100})
+	s.macroLineTo(Vec2{0, 100})
+	s.macroClosePath()
 	s.macroOperation(ropSetFillColor)
-	s.macroUseConstColor(color)
+	s.macroUseVar(colorVar)
 	s.macroOperation(ropFill)
+	s.macroSetStrokeColor(nanovgo.RGBA(255, 255, 255, 255))
+	s.macroSetStrokeWidth(4)
+	s.macroSetLineJoin(lineJoinRound)
+	s.macroStroke()
 
 	s.macroEnd()
 
 	return macroNumber
 }
 
-func (s *Server) createTestNode(macroNumber MacroNumber, size Vec2) NodeNumber {
+func (s *Server) createTestNode(macroNumber MacroNumber, color nanovgo.Color) NodeNumber {
 	nodeNumber := s.nodeCreate()
-	s.nodeSetContent(nodeNumber, macroNumber)
-	// s.pushUint16(uint16(width))
-	// s.pushUint16(uint16(height))
+	s.nodeSetContent(nodeNumber, macroNumber, color)
 	return nodeNumber
 }
 
+func (s *Server) macroBeginPath() {
+	s.macroOperation(ropBeginPath)
+	s.macroPathPoint = Vec2{}
+	s.macroSubpathStart = Vec2{}
+	s.macroPathStarted = false
+	s.macroPathKnown = true
+}
+
+func (s *Server) macroMoveTo(point Vec2) {
+	s.macroPathTo(point, ropMoveTo, ropMoveToDelta8, ropMoveToDelta16)
+	s.macroSubpathStart = s.macroPathPoint
+	s.macroPathStarted = true
+	s.macroPathKnown = true
+}
+
+func (s *Server) macroLineTo(point Vec2) {
+	s.macroPathTo(point, ropLineTo, ropLineToDelta8, ropLineToDelta16)
+}
+
+func (s *Server) macroClosePath() {
+	s.macroOperation(ropClosePath)
+	s.macroPathPoint = s.macroSubpathStart
+}
+
+// macroPathTo adds a path point with the shortest operand that reproduces it
+// exactly: an 8 or 16 bit delta from the current point, or the absolute point
+// if the current point isn't known.
+func (s *Server) macroPathTo(point Vec2, absolute uint8, delta8 uint8, delta16 uint8) {
+	delta := point.Subtract(s.macroPathPoint)
+	constBytecode := s.newConstBytecode()
+	if !s.macroPathKnown {
+		s.macroOperation(absolute)
+		constBytecode.pushVec2(point)
+		s.macroPathPoint = constBytecode.popVec2()
+	} else if fitsDelta(delta, 8) {
+		s.macroOperation(delta8)
+		constBytecode.pushDelta8(delta)
+		s.macroPathPoint = s.macroPathPoint.Add(constBytecode.popDelta8())
+	} else if fitsDelta(delta, 16) {
+		s.macroOperation(delta16)
+		constBytecode.pushDelta16(delta)
+		s.macroPathPoint = s.macroPathPoint.Add(constBytecode.popDelta16())
+	} else {
+		s.macroOperation(absolute)
+		constBytecode.pushVec2(point)
+		// track the point as the client decodes it, so following deltas don't drift
+		s.macroPathPoint = constBytecode.popVec2()
+	}
+	s.macroUseConst(constBytecode.bytes)
+}
+
 func (s *Server) macroUseConstColor(color nanovgo.Color) {
-	s.macroUseConstUint8(uint8(color.R * 255))
-	s.macroUseConstUint8(uint8(color.G * 255))
-	s.macroUseConstUint8(uint8(color.B * 255))
-	s.macroUseConstUint8(uint8(color.A * 255))
+	constBytecode := s.newConstBytecode()
+	constBytecode.pushRgba(color)
+	s.macroUseConst(constBytecode.bytes)
 }
 
 //-----------------UPDATE OPERATIONS----------------------------
@@ -145,91 +460,364 @@ func (s *Server) macroUseConstColor(color nanovgo.Color) {
 //-----------------UPDATE OPERATIONS----------------------------
 //-----------------UPDATE OPERATIONS----------------------------
 
+// update writes an update operation, checking the operands against the opcode
+// table.
+func (s *Server) update(opcode uint8, operands ...interface{}) {
+	s.pushOperation(updateOpcodes[:], opcode, operands...)
+}
+
 func (s *Server) macroStart() MacroNumber {
-	s.pushOpcode(uopMacroStart)
+	macroNumber := s.newMacroNumber()
+	s.startDefinition(macroNumber)
+	return macroNumber
+}
+
+// newMacroNumber returns the number of a deleted macro if there is one, so
+// the numbers of a long session stay small.
+func (s *Server) newMacroNumber() MacroNumber {
+	if n := len(s.freeMacros); n > 0 {
+		macroNumber := s.freeMacros[n-1]
+		s.freeMacros = s.freeMacros[:n-1]
+		return macroNumber
+	}
 	macroNumber := MacroNumber(s.macroCount)
-	s.pushMacroNumber(macroNumber)
 	s.macroCount++
 	return macroNumber
 }
 
+// macroRedefine starts a new definition of a defined macro. Nodes showing it
+// and macros calling it use the new definition, which must have the same
+// variables if there are any.
+func (s *Server) macroRedefine(macroNumber MacroNumber) {
+	if _, ok := s.macroVariables[macroNumber]; !ok {
+		s.encodeError(fmt.Sprint("macroRedefine: undefined macro ", macroNumber))
+	}
+	s.startDefinition(macroNumber)
+}
+
+func (s *Server) startDefinition(macroNumber MacroNumber) {
+	s.dictionary.startDefinition(len(s.bytes))
+	s.update(uopMacroStart, macroNumber)
+	s.wipMacroNumber = macroNumber
+	s.wipVariables = []OperandType{}
+	s.wipCalls = nil
+	s.macroPending = nil
+	s.macroBlocks = 0
+	s.macroPathKnown = false
+}
+
 func (s *Server) macroEnd() {
-	s.pushOpcode(uopMacroEnd)
-	s.macroVariableCount = 0
+	macroNumber := s.wipMacroNumber
+	s.checkOperandsGiven("macroEnd")
+	if s.macroBlocks > 0 {
+		s.encodeError(fmt.Sprint("macroEnd: ", s.macroBlocks, " blocks of macro ", macroNumber, " aren't ended"))
+	}
+	if old, ok := s.macroVariables[macroNumber]; ok && s.macroUsed(macroNumber) && !sameOperandTypes(old, s.wipVariables) {
+		s.encodeError(fmt.Sprint("macroEnd: redefinition of macro ", macroNumber, " in use changes its variables"))
+	}
+	s.update(uopMacroEnd)
+	s.dictionary.endDefinition(len(s.bytes))
+	oldCalls := s.macroCalls[macroNumber]
+	s.addCalls(oldCalls, -1)
+	s.addCalls(s.wipCalls, 1)
+	s.macroVariables[macroNumber] = s.wipVariables
+	s.macroCalls[macroNumber] = s.wipCalls
+	s.wipVariables = nil
+	for _, called := range oldCalls {
+		s.deleteIfReleased(called)
+	}
+}
+
+func (s *Server) addCalls(calls []MacroNumber, delta int) {
+	for _, macroNumber := range calls {
+		s.macroCallers[macroNumber] += delta
+	}
+}
+
+// otherCallers returns the calls of a macro by other macros.
+func (s *Server) otherCallers(macroNumber MacroNumber) int {
+	callers := s.macroCallers[macroNumber]
+	for _, called := range s.macroCalls[macroNumber] {
+		if called == macroNumber {
+			callers--
+		}
+	}
+	return callers
+}
+
+// macroUsed reports whether a node shows the macro or another macro calls
+// it.
+func (s *Server) macroUsed(macroNumber MacroNumber) bool {
+	return s.otherCallers(macroNumber) > 0 || s.macroNodes[macroNumber] > 0
+}
+
+func (s *Server) isLibraryMacro(macroNumber MacroNumber) bool {
+	for _, libraryNumber := range s.libraryNumbers {
+		if libraryNumber == macroNumber {
+			return true
+		}
+	}
+	return false
+}
+
+// macroDelete frees a macro no other macro calls. Nodes showing it keep their
+// content. Library macros stay bound for the whole session.
+func (s *Server) macroDelete(macroNumber MacroNumber) {
+	if _, ok := s.macroVariables[macroNumber]; !ok {
+		s.encodeError(fmt.Sprint("macroDelete: undefined macro ", macroNumber))
+	}
+	if s.isLibraryMacro(macroNumber) {
+		s.encodeError(fmt.Sprint("macroDelete: macro ", macroNumber, " is bound from the library"))
+	}
+	if callers := s.otherCallers(macroNumber); callers > 0 {
+		s.encodeError(fmt.Sprint("macroDelete: macro ", macroNumber, " is still called ", callers, " times by other macros"))
+	}
+	s.update(uopMacroDelete, macroNumber)
+	calls := s.macroCalls[macroNumber]
+	s.addCalls(calls, -1)
+	delete(s.macroVariables, macroNumber)
+	delete(s.macroCalls, macroNumber)
+	delete(s.macroNodes, macroNumber)
+	delete(s.macroReleased, macroNumber)
+	s.freeMacros = append(s.freeMacros, macroNumber)
+	for nodeNumber, content := range s.nodeContents {
+		if content == macroNumber {
+			delete(s.nodeContents, nodeNumber)
+		}
+	}
+	for _, called := range calls {
+		s.deleteIfReleased(called)
+	}
+}
+
+// macroRelease tells the server the caller won't show or call the macro
+// again, so it is deleted as soon as no node shows it and no other macro
+// calls it, which may be right away. Macros that aren't released are kept
+// even while unused, as they may be defined ahead of the frames using them.
+func (s *Server) macroRelease(macroNumber MacroNumber) {
+	if _, ok := s.macroVariables[macroNumber]; !ok {
+		s.encodeError(fmt.Sprint("macroRelease: undefined macro ", macroNumber))
+	}
+	if s.isLibraryMacro(macroNumber) {
+		s.encodeError(fmt.Sprint("macroRelease: macro ", macroNumber, " is bound from the library"))
+	}
+	s.macroReleased[macroNumber] = true
+	s.deleteIfReleased(macroNumber)
+}
+
+// deleteIfReleased deletes a released macro once it is unused, and with it
+// the released macros only it called.
+func (s *Server) deleteIfReleased(macroNumber MacroNumber) {
+	if s.macroReleased[macroNumber] && !s.macroUsed(macroNumber) {
+		s.macroDelete(macroNumber)
+	}
 }
 
 func (s *Server) macroOperation(opcode uint8) {
-	s.pushOpcode(uopMacroOperation)
-	s.pushUint8(opcode)
+	if opcode >= ropCodeCount {
+		s.encodeError(fmt.Sprint("macroOperation: invalid render opcode ", opcode))
+	}
+	s.checkOperandsGiven("macroOperation")
+	switch opcode {
+	case ropRepeat, ropIf:
+		s.macroBlocks++
+	case ropEnd:
+		if s.macroBlocks == 0 {
+			s.encodeError("macroOperation: ropEnd without an open block")
+		}
+		s.macroBlocks--
+	}
+	// the current point after a block boundary, call or computed operation
+	// depends on the render, so the next path point is sent absolute
+	switch opcode {
+	case ropRepeat, ropIf, ropEnd, ropMacroCall, ropApply, ropUseAnchor, ropExtended:
+		s.macroPathKnown = false
+	}
+	s.update(uopMacroOperation, opcode)
+	s.macroOpcode = opcode
+	s.macroPending = renderOpcodes[opcode].operands
 }
 
-func (s *Server) macroVar(varSize int) uint16 {
-	s.pushOpcode(uopMacroVar)
-	s.pushSize(varSize)
-	variableNumber := s.macroVariableCount
-	s.macroVariableCount++
+// checkOperandsGiven fails if the last operation of the macro being defined
+// is missing operands.
+func (s *Server) checkOperandsGiven(name string) {
+	if len(s.macroPending) > 0 {
+		s.encodeError(fmt.Sprint(name, ": ", opcodeName(true, s.macroOpcode), " is missing its ", s.macroPending[0], " operand"))
+	}
+}
+
+// nextPending returns the type of the operand the next constant or variable
+// is for, or false if the operation doesn't take more operands.
+func (s *Server) nextPending() (OperandType, bool) {
+	if len(s.macroPending) == 0 {
+		return 0, false
+	}
+	operandType := s.macroPending[0]
+	s.macroPending = s.macroPending[1:]
+	return operandType, true
+}
+
+// macroVar declares a variable of the macro being defined, the value is
+// given for every use of the macro.
+func (s *Server) macroVar(variableType OperandType) uint16 {
+	if !variableType.isVariableType() {
+		s.encodeError("macroVar: invalid variable type " + variableType.String())
+	}
+	s.update(uopMacroVar, variableType)
+	variableNumber := uint16(len(s.wipVariables))
+	s.wipVariables = append(s.wipVariables, variableType)
 	return variableNumber
 }
 
 func (s *Server) macroUseVar(variableNumber uint16) {
-	s.pushOpcode(uopMacroUseVar)
-	s.pushUint16(variableNumber)
+	if int(variableNumber) >= len(s.wipVariables) {
+		s.encodeError(fmt.Sprint("macroUseVar: undeclared variable ", variableNumber))
+	}
+	variableType := s.wipVariables[variableNumber]
+	operandType, ok := s.nextPending()
+	if !ok {
+		s.encodeError("macroUseVar: variable used past the operands of " + opcodeName(true, s.macroOpcode))
+	} else if operandType != variableType {
+		s.encodeError(fmt.Sprint("macroUseVar: ", variableType, " variable used for ", operandType, " operand of ", opcodeName(true, s.macroOpcode)))
+	}
+	s.update(uopMacroUseVar, variableNumber)
+	// the value is only known at render time, and may be a path point
+	s.macroPathKnown = false
+}
+
+// macroArgs encodes the values of a macro's variables, fixed width as they are
+// spliced into render bytecode.
+func (s *Server) macroArgs(macroNumber MacroNumber, args []interface{}) []byte {
+	variables, ok := s.macroVariables[macroNumber]
+	if !ok {
+		s.encodeError(fmt.Sprint("macroArgs: undefined macro ", macroNumber))
+	}
+	if len(args) != len(variables) {
+		s.encodeError(fmt.Sprint("macroArgs: ", len(args), " arguments given for ", len(variables), " variables of macro ", macroNumber))
+	}
+	argsBytecode := s.newConstBytecode()
+	for i, variableType := range variables {
+		if !argsBytecode.pushOperand(variableType, args[i]) {
+			s.encodeError(fmt.Sprintf("macroArgs: argument %d is %T, expected %s", i, args[i], variableType))
+		}
+	}
+	return argsBytecode.bytes
+}
+
+// newConstBytecode returns a bytecode for encoding macro operands: fixed width,
+// in the stream's number format.
+func (s *Server) newConstBytecode() *Bytecode {
+	bytecode := NewBytecode()
+	bytecode.numberFormat = s.header.numberFormat
+	return bytecode
+}
+
+// macroUseConst copies operand bytes into the macro. Macro bodies are render
+// bytecode and always use fixed width operands.
+func (s *Server) macroUseConst(constBytes []byte) {
+	operandType, ok := s.nextPending()
+	if !ok {
+		s.encodeError("macroUseConst: constant past the operands of " + opcodeName(true, s.macroOpcode))
+	}
+	if err := checkMacroConst(operandType, constBytes, s.header.numberFormat); err != nil {
+		s.encodeError("macroUseConst: " + opcodeName(true, s.macroOpcode) + ": " + err.Error())
+	}
+	s.update(uopMacroUseConst, constBytes)
 }
 
 func (s *Server) macroUseConstUint8(const8 uint8) {
-	s.pushOpcode(uopMacroUseConst)
-	s.pushSize(1)
-	s.pushUint8(const8)
+	s.macroUseConst([]byte{const8})
 }
 
 func (s *Server) macroUseConstUint16(const16 uint16) {
-	s.pushOpcode(uopMacroUseConst)
-	s.pushSize(2)
-	s.pushUint16(const16)
+	constBytecode := s.newConstBytecode()
+	constBytecode.pushUint16(const16)
+	s.macroUseConst(constBytecode.bytes)
 }
 
-func (s *Server) macroUseConstVec2(constVec2 Vec2) {
-	s.pushOpcode(uopMacroUseConst)
-	s.pushSize(sizeOfVec2)
-	s.pushVec2(constVec2)
+// macroUseConstNumber returns the number as the client decodes it.
+func (s *Server) macroUseConstNumber(number float64) float64 {
+	constBytecode := s.newConstBytecode()
+	constBytecode.pushFloat64(number)
+	s.macroUseConst(constBytecode.bytes)
+	return constBytecode.popFloat64()
+}
+
+// macroUseConstVec2 returns the vector as the client decodes it.
+func (s *Server) macroUseConstVec2(constVec2 Vec2) Vec2 {
+	constBytecode := s.newConstBytecode()
+	constBytecode.pushVec2(constVec2)
+	s.macroUseConst(constBytecode.bytes)
+	return constBytecode.popVec2()
+}
+
+func (s *Server) macroUseConstMacroNumber(macroNumber MacroNumber) {
+	constBytecode := s.newConstBytecode()
+	constBytecode.pushMacroNumber(macroNumber)
+	s.macroUseConst(constBytecode.bytes)
 }
 
 func (s *Server) nodeCreate() NodeNumber {
-	s.pushOpcode(uopNodeCreate)
 	nodeNumber := NodeNumber(s.nodeCount)
-	s.pushNodeNumber(nodeNumber)
+	s.update(uopNodeCreate, nodeNumber)
 	s.nodeCount++
 	return nodeNumber
 }
 
-func (s *Server) nodeSetContent(nodeNumber NodeNumber, macroNumber MacroNumber) {
-	s.pushOpcode(uopNodeSetContent)
-	s.pushNodeNumber(nodeNumber)
-	s.pushMacroNumber(macroNumber)
+func (s *Server) nodeSetContent(nodeNumber NodeNumber, macroNumber MacroNumber, args ...interface{}) {
+	s.update(uopNodeSetContent, nodeNumber, macroNumber, s.macroArgs(macroNumber, args))
+	old, hadContent := s.nodeContents[nodeNumber]
+	s.nodeContents[nodeNumber] = macroNumber
+	s.macroNodes[macroNumber]++
+	if hadContent {
+		s.macroNodes[old]--
+		s.deleteIfReleased(old)
+	}
+}
+
+// nodeSetArgument changes one argument of a node's content.
+func (s *Server) nodeSetArgument(nodeNumber NodeNumber, variableNumber uint16, value interface{}) {
+	macroNumber, ok := s.nodeContents[nodeNumber]
+	if !ok {
+		s.encodeError(fmt.Sprint("nodeSetArgument: node ", nodeNumber, " has no macro content"))
+	}
+	variables := s.macroVariables[macroNumber]
+	if int(variableNumber) >= len(variables) {
+		s.encodeError(fmt.Sprint("nodeSetArgument: macro ", macroNumber, " has no variable ", variableNumber))
+	}
+	constBytecode := s.newConstBytecode()
+	if !constBytecode.pushOperand(variables[variableNumber], value) {
+		s.encodeError(fmt.Sprintf("nodeSetArgument: value is %T, expected %s", value, variables[variableNumber]))
+	}
+	s.update(uopNodeSetArgument, nodeNumber, variableNumber, constBytecode.bytes)
 }
 
 func (s *Server) nodeSetParent(nodeNumber NodeNumber, parentNumber NodeNumber) {
-	s.pushOpcode(uopNodeSetParent)
-	s.pushNodeNumber(nodeNumber)
-	s.pushNodeNumber(parentNumber)
+	s.update(uopNodeSetParent, nodeNumber, parentNumber)
 }
 
 func (s *Server) nodeSetPosition(nodeNumber NodeNumber, position Vec2) {
-	s.pushOpcode(uopNodeSetPosition)
-	s.pushNodeNumber(nodeNumber)
-	s.pushVec2(position)
+	s.update(uopNodeSetPosition, nodeNumber, position)
 }
 
 func (s *Server) nodeSetRotation(nodeNumber NodeNumber, rotation float64) {
-	s.pushOpcode(uopNodeSetRotation)
-	s.pushNodeNumber(nodeNumber)
-	s.pushRotation(rotation)
+	s.update(uopNodeSetRotation, nodeNumber, rotation)
 }
 
 func (s *Server) nodeSetScale(nodeNumber NodeNumber, scale Vec2) {
-	s.pushOpcode(uopNodeSetScale)
-	s.pushNodeNumber(nodeNumber)
-	s.pushScale(scale)
+	s.update(uopNodeSetScale, nodeNumber, scale)
+}
+
+func (s *Server) nodeSetTransform(nodeNumber NodeNumber, transform Matrix33) {
+	s.update(uopNodeSetTransform, nodeNumber, transform)
+}
+
+func (s *Server) nodeSetPivot(nodeNumber NodeNumber, pivot Vec2) {
+	s.update(uopNodeSetPivot, nodeNumber, pivot)
+}
+
+func (s *Server) anchorCreate(anchorNumber AnchorNumber, nodeNumber NodeNumber, position Vec2) {
+	s.update(uopAnchorCreate, anchorNumber, nodeNumber, position)
 }
 
 //-------------------------RENDER OPERATIONS---------------------------
@@ -239,20 +827,33 @@ func (s *Server) nodeSetScale(nodeNumber NodeNumber, scale Vec2) {
 //-------------------------RENDER OPERATIONS---------------------------
 //-------------------------RENDER OPERATIONS---------------------------
 
-func (s *Server) beginPath() {
-	s.pushOpcode(ropBeginPath)
-}
+// forwardVariable is an argument of macroMacroCall that passes on a variable
+// of the macro being defined.
+type forwardVariable uint16
 
-func (s *Server) setFillColor(color nanovgo.Color) {
-	s.pushOpcode(ropSetFillColor)
-	s.pushRgba(color)
-}
-
-func (s *Server) fill() {
-	s.pushOpcode(ropFill)
-}
-
-func (s *Server) macroCall(macroNumber uint16) {
-	s.pushOpcode(ropMacroCall)
-	s.pushUint16(macroNumber)
+// macroMacroCall adds a call of another macro to the macro being defined. Each
+// argument is a value or a forwardVariable.
+func (s *Server) macroMacroCall(macroNumber MacroNumber, args ...interface{}) {
+	variables, ok := s.macroVariables[macroNumber]
+	if !ok {
+		s.encodeError(fmt.Sprint("macroMacroCall: undefined macro ", macroNumber))
+	}
+	if len(args) != len(variables) {
+		s.encodeError(fmt.Sprint("macroMacroCall: ", len(args), " arguments given for ", len(variables), " variables of macro ", macroNumber))
+	}
+	s.macroOperation(ropMacroCall)
+	s.macroUseConstMacroNumber(macroNumber)
+	s.wipCalls = append(s.wipCalls, macroNumber)
+	s.macroPending = variables
+	for i, arg := range args {
+		if variable, ok := arg.(forwardVariable); ok {
+			s.macroUseVar(uint16(variable))
+			continue
+		}
+		constBytecode := s.newConstBytecode()
+		if !constBytecode.pushOperand(variables[i], arg) {
+			s.encodeError(fmt.Sprintf("macroMacroCall: argument %d is %T, expected %s", i, arg, variables[i]))
+		}
+		s.macroUseConst(constBytecode.bytes)
+	}
 }
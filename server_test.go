@@ -0,0 +1,244 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/shibukawa/nanovgo"
+)
+
+// newTestContext returns a nanovgo context that collects paths without a GL
+// backend. Filling and stroking need the backend, so test clients skip them.
+func newTestContext() *nanovgo.Context {
+	ctx := &nanovgo.Context{}
+	ctx.Save()
+	ctx.Reset()
+	return ctx
+}
+
+// newTestSession connects a server and a client and applies the init frame.
+func newTestSession(t *testing.T) (*Server, *Client) {
+	t.Helper()
+	server := NewServer()
+	client := NewClient(newTestContext())
+	client.renderOperations[ropFill] = func(n *Node) {}
+	client.renderOperations[ropStroke] = func(n *Node) {}
+	answer, err := client.Handshake(server.Offer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Accept(answer); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := server.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Update(frame); err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+// sendFrame writes a frame with the server operations of build and applies it
+// to the client.
+func sendFrame(t *testing.T, server *Server, client *Client, build func()) {
+	t.Helper()
+	if err := server.build(build); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Update(server.frame()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// renderTestNode renders the content of a node, returning the current path
+// point after each of the given operations.
+func renderTestNode(t *testing.T, client *Client, nodeNumber NodeNumber, recorded ...uint8) []Vec2 {
+	t.Helper()
+	var points []Vec2
+	for _, opcode := range recorded {
+		operation := client.renderOperations[opcode]
+		client.renderOperations[opcode] = func(n *Node) {
+			operation(n)
+			points = append(points, client.pathPoint)
+		}
+		defer func(opcode uint8) { client.renderOperations[opcode] = operation }(opcode)
+	}
+	node := client.nodes[nodeNumber]
+	client.root.UpdateLocalToGlobalMatrix()
+	node.UpdateLocalToGlobalMatrix()
+	if err := client.renderContent(node); err != nil {
+		t.Fatal(err)
+	}
+	return points
+}
+
+var lineToOpcodes = []uint8{ropLineTo, ropLineToDelta8, ropLineToDelta16}
+
+func samePoints(a []Vec2, b []Vec2) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMacroPathPointsAfterBlocksAndCalls(t *testing.T) {
+	server, client := newTestSession(t)
+	var node NodeNumber
+	sendFrame(t, server, client, func() {
+		callee := server.macroStart()
+		server.macroBeginPath()
+		server.macroMoveTo(Vec2{50, 50})
+		server.macroLineTo(Vec2{60, 50})
+		server.macroEnd()
+
+		macroNumber := server.macroStart()
+		// follows straight on from the callee's definition
+		server.macroLineTo(Vec2{3, 4})
+		server.macroRepeat(3)
+		server.macroLineTo(Vec2{10, 0})
+		server.macroEndBlock()
+		server.macroLineTo(Vec2{10, 5})
+		server.macroMacroCall(callee)
+		server.macroLineTo(Vec2{10, 6})
+		server.macroEnd()
+
+		node = server.nodeCreate()
+		server.nodeSetContent(node, macroNumber)
+	})
+	points := renderTestNode(t, client, node, lineToOpcodes...)
+	want := []Vec2{{3, 4}, {10, 0}, {10, 0}, {10, 0}, {10, 5}, {60, 50}, {10, 6}}
+	if !samePoints(points, want) {
+		t.Fatalf("path points %v, want %v", points, want)
+	}
+}
+
+func TestNodeContentStartsAtOrigin(t *testing.T) {
+	server, client := newTestSession(t)
+	var node NodeNumber
+	sendFrame(t, server, client, func() {
+		macroNumber := server.macroStart()
+		server.macroOperation(ropLineToRelative)
+		server.macroUseConstVec2(Vec2{3, 4})
+		server.macroEnd()
+		node = server.nodeCreate()
+		server.nodeSetContent(node, macroNumber)
+	})
+	// left over from the node drawn before
+	client.pathPoint = Vec2{100, 100}
+	points := renderTestNode(t, client, node, ropLineToRelative)
+	if !samePoints(points, []Vec2{{3, 4}}) {
+		t.Fatalf("path points %v, want [{3 4}]", points)
+	}
+}
+
+func TestDroppedFrameRollsBackServerState(t *testing.T) {
+	server, client := newTestSession(t)
+	nodeCount, macroCount := server.nodeCount, server.macroCount
+	err := server.build(func() {
+		server.nodeCreate()
+		caller := server.macroStart()
+		server.macroMacroCall(testMacro, colorBlue)
+		server.macroEnd()
+		server.nodeSetContent(server.nodeCreate(), caller)
+		server.nodeSetArgument(testNode1, 1, colorBlue) // testMacro has one variable
+	})
+	if _, ok := err.(*EncodeError); !ok {
+		t.Fatalf("build returned %v, want an EncodeError", err)
+	}
+	if server.nodeCount != nodeCount || server.macroCount != macroCount {
+		t.Fatalf("counts %d, %d after a dropped frame, want %d, %d", server.nodeCount, server.macroCount, nodeCount, macroCount)
+	}
+	if server.macroCallers[testMacro] != 0 {
+		t.Fatalf("testMacro has %d callers after a dropped frame", server.macroCallers[testMacro])
+	}
+
+	var node NodeNumber
+	var caller MacroNumber
+	sendFrame(t, server, client, func() {
+		node = server.nodeCreate()
+		caller = server.macroStart()
+		server.macroMacroCall(testMacro, colorBlue)
+		server.macroEnd()
+		server.nodeSetContent(node, caller)
+	})
+	if node != NodeNumber(nodeCount) || caller != MacroNumber(macroCount) {
+		t.Fatalf("node %d and macro %d after a dropped frame, want %d and %d", node, caller, nodeCount, macroCount)
+	}
+	if client.nodes[node] == nil || client.nodes[node].content != client.macros[caller] {
+		t.Fatal("client didn't apply the frame after the dropped one")
+	}
+	if client.macroCallers[testMacro] != server.macroCallers[testMacro] {
+		t.Fatalf("client counts %d callers of testMacro, server %d", client.macroCallers[testMacro], server.macroCallers[testMacro])
+	}
+}
+
+func TestReleasedMacrosAreDeleted(t *testing.T) {
+	server, client := newTestSession(t)
+	defined := func(macroNumbers ...MacroNumber) bool {
+		for _, macroNumber := range macroNumbers {
+			_, onServer := server.macroVariables[macroNumber]
+			_, onClient := client.macros[macroNumber]
+			if onServer != onClient {
+				t.Fatalf("macro %d defined on the server %v, on the client %v", macroNumber, onServer, onClient)
+			}
+			if !onServer {
+				return false
+			}
+		}
+		return true
+	}
+	var called, shown, ahead, reused MacroNumber
+	var node NodeNumber
+	sendFrame(t, server, client, func() {
+		called = server.macroStart()
+		server.macroBeginPath()
+		server.macroEnd()
+		shown = server.macroStart()
+		server.macroMacroCall(called)
+		server.macroEnd()
+		// defined ahead of the frame showing it
+		ahead = server.macroStart()
+		server.macroBeginPath()
+		server.macroEnd()
+		node = server.nodeCreate()
+		server.nodeSetContent(node, shown)
+		server.macroRelease(called)
+	})
+	sendFrame(t, server, client, server.updateScene)
+	if !defined(called, shown, ahead, testMacro) {
+		t.Fatal("a macro in use or not released was deleted")
+	}
+
+	sendFrame(t, server, client, func() {
+		server.macroRelease(shown)
+		server.nodeSetContent(node, ahead)
+	})
+	if defined(shown) || defined(called) {
+		t.Fatal("released macros were kept once unused")
+	}
+	if !defined(ahead) || client.macroCallers[called] != 0 {
+		t.Fatalf("macro %d deleted or %d callers of a deleted macro counted", ahead, client.macroCallers[called])
+	}
+
+	// the freed numbers are given out again
+	macroCount := server.macroCount
+	sendFrame(t, server, client, func() {
+		reused = server.macroStart()
+		server.macroEnd()
+	})
+	if server.macroCount != macroCount || (reused != shown && reused != called) || !defined(reused) {
+		t.Fatalf("new macro %d with %d numbers used, want a freed number", reused, server.macroCount)
+	}
+}
+
+// closePoints reports whether two points are equal up to rounding errors.
+func closePoints(a Vec2, b Vec2) bool {
+	return math.Abs(a.X-b.X) < 1e-9 && math.Abs(a.Y-b.Y) < 1e-9
+}
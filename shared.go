@@ -1,13 +1,10 @@
 package main
 
+import "strconv"
+
 const windowWidth = 600
 const windowHeight = 500
 
-const (
-	sizeOfVec2 = 8
-	sizeOfRect = 16
-)
-
 type Rect struct {
 	position Vec2
 	size     Vec2
@@ -35,6 +32,13 @@ func (v Vec2) Add(o Vec2) Vec2 {
 	}
 }
 
+func (v Vec2) Subtract(o Vec2) Vec2 {
+	return Vec2{
+		X: v.X - o.X,
+		Y: v.Y - o.Y,
+	}
+}
+
 func (v Vec2) MultiplyFloat(f float64) Vec2 {
 	return Vec2{
 		X: v.X * f,
@@ -48,3 +52,8 @@ func (v Vec2) DivideFloat(f float64) Vec2 {
 		Y: v.Y / f,
 	}
 }
+
+// formatFloat prints the shortest representation that parses back to value.
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
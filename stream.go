@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// Streaming bytecode decodes straight from an io.Reader. Only a window of at
+// most streamBufferSize bytes is kept: consumed bytes are dropped whenever more
+// are read, so no single operand may be larger than the window.
+
+const streamBufferSize = 4096
+
+// maxFrameSize bounds the payload length a streaming client accepts, a larger
+// length is taken as a corrupt frame header.
+const maxFrameSize = 1 << 20
+
+func NewBytecodeFromReader(reader io.Reader) *Bytecode {
+	return &Bytecode{
+		bytes:  make([]byte, 0, streamBufferSize),
+		reader: reader,
+	}
+}
+
+// need makes sure count bytes can be popped, reading more from the reader of a
+// streaming bytecode until they arrive or the stream ends. A stream that ends
+// early is left to the pop's range check.
+func (b *Bytecode) need(count int) {
+	if b.reader == nil || len(b.bytes)-b.i >= count {
+		return
+	}
+	if count > cap(b.bytes) {
+		b.error(errorOutOfRange, "operand larger than the stream buffer")
+	}
+	b.discarded += b.i
+	b.bytes = b.bytes[:copy(b.bytes[:cap(b.bytes)], b.bytes[b.i:])]
+	b.i = 0
+	n, err := io.ReadAtLeast(b.reader, b.bytes[len(b.bytes):cap(b.bytes)], count-len(b.bytes))
+	b.bytes = b.bytes[:len(b.bytes)+n]
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		b.error(errorRead, err.Error())
+	}
+}
+
+// needVarint reads until the buffer holds a complete varint or the stream
+// ends, without waiting for bytes past the varint.
+func (b *Bytecode) needVarint() {
+	if b.reader == nil {
+		return
+	}
+	for count := 1; count <= binary.MaxVarintLen64; count++ {
+		b.need(count)
+		if len(b.bytes)-b.i < count || b.bytes[b.i+count-1] < 0x80 {
+			return
+		}
+	}
+}
+
+// more reports whether there are bytes left to pop.
+func (b *Bytecode) more() bool {
+	b.need(1)
+	return b.i < len(b.bytes)
+}
+
+// Read hands out the bytes not popped yet, buffered ones first, so a part of
+// the stream can be decoded by another Bytecode.
+func (b *Bytecode) Read(p []byte) (int, error) {
+	if b.i < len(b.bytes) {
+		n := copy(p, b.bytes[b.i:])
+		b.i += n
+		return n, nil
+	}
+	if b.reader == nil {
+		return 0, io.EOF
+	}
+	b.discarded += len(b.bytes)
+	b.bytes, b.i = b.bytes[:0], 0
+	n, err := b.reader.Read(p)
+	b.discarded += n
+	return n, err
+}
+
+// popFrameHeader reads the payload length, sequence and timestamp of a frame.
+func (b *Bytecode) popFrameHeader() (length int, frame Frame) {
+	var fields [3]uint32
+	for i := range fields {
+		if b.varint {
+			value := b.popUvarint()
+			if value > math.MaxUint32 {
+				b.error(errorOutOfRange, "frame header field overflow")
+			}
+			fields[i] = uint32(value)
+		} else {
+			fields[i] = b.popUint32()
+		}
+	}
+	if fields[0] > maxFrameSize {
+		b.error(errorOutOfRange, "frame larger than maxFrameSize")
+	}
+	return int(fields[0]), Frame{sequence: fields[1], timestamp: fields[2]}
+}
+
+var errTruncatedFrame = errors.New("stream ends inside a frame")
+
+// payloadReader reads the payload of a frame from the stream. Unlike
+// io.LimitReader it reports a stream that ends before the payload does as an
+// error, so a cut frame isn't taken as a complete one.
+type payloadReader struct {
+	reader    io.Reader
+	remaining int
+}
+
+func (p *payloadReader) Read(bytes []byte) (int, error) {
+	if p.remaining == 0 {
+		return 0, io.EOF
+	}
+	if len(bytes) > p.remaining {
+		bytes = bytes[:p.remaining]
+	}
+	n, err := p.reader.Read(bytes)
+	p.remaining -= n
+	if err == io.EOF && p.remaining > 0 {
+		err = errTruncatedFrame
+	}
+	return n, err
+}
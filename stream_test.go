@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// connectTestClient runs the handshake of a server with the given features and
+// a new client.
+func connectTestClient(t *testing.T, features uint32) (*Server, *Client) {
+	t.Helper()
+	server := NewServer()
+	server.features = features
+	client := NewClient(nil)
+	answer, err := client.Handshake(server.Offer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Accept(answer); err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+func TestReadFrame(t *testing.T) {
+	for _, features := range testFeatureSets {
+		server, client := connectTestClient(t, features)
+		var stream bytes.Buffer
+		if err := server.WriteInit(&stream); err != nil {
+			t.Fatal(err)
+		}
+		const frames = 40
+		for i := 0; i < frames; i++ {
+			if err := server.WriteUpdate(&stream); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// the same frames applied from memory
+		reference := NewClient(nil)
+		if _, err := reference.Handshake(EncodeStreamHeader(server.offer)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := reference.Update(stream.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+
+		// every read returns a single byte, so operands arrive in pieces
+		reader := iotest.OneByteReader(&stream)
+		for i := 0; i <= frames; i++ {
+			gaps, err := client.ReadFrame(reader)
+			if err != nil || len(gaps) != 0 {
+				t.Fatalf("features %#x, frame %d: gaps %v, error %v", features, i, gaps, err)
+			}
+		}
+		if _, err := client.ReadFrame(reader); err != io.EOF {
+			t.Fatalf("features %#x: ReadFrame at the end returned %v, want io.EOF", features, err)
+		}
+		if client.nextSequence != server.sequence {
+			t.Fatalf("features %#x: next sequence %d, want %d", features, client.nextSequence, server.sequence)
+		}
+		for _, node := range []NodeNumber{testNode1, testNode2} {
+			if client.nodes[node].position != reference.nodes[node].position || client.nodes[node].rotation != reference.nodes[node].rotation {
+				t.Fatalf("features %#x: node %d differs from the one updated from memory", features, node)
+			}
+		}
+	}
+}
+
+func TestReadFrameTruncated(t *testing.T) {
+	for _, features := range testFeatureSets {
+		server, client := connectTestClient(t, features)
+		var stream bytes.Buffer
+		if err := server.WriteInit(&stream); err != nil {
+			t.Fatal(err)
+		}
+		initSize := stream.Len()
+		if err := server.WriteUpdate(&stream); err != nil {
+			t.Fatal(err)
+		}
+		cut := bytes.NewReader(stream.Bytes()[:initSize+(stream.Len()-initSize)/2])
+		if _, err := client.ReadFrame(cut); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.ReadFrame(cut); err == nil || err == io.EOF {
+			t.Fatalf("features %#x: ReadFrame of a cut frame returned %v", features, err)
+		}
+		if client.nextSequence == 2 && client.droppedFrames == 0 {
+			t.Fatalf("features %#x: cut frame was applied", features)
+		}
+		if _, err := client.ReadFrame(cut); err != io.EOF {
+			t.Fatalf("features %#x: ReadFrame after the cut frame returned %v, want io.EOF", features, err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/shibukawa/nanovgo"
+)
+
+// ropStroke outlines the current path with the stroke state set by the
+// operations before it: color, width, line cap, line join and miter limit.
+// The width is in local units and scales with the node transform by default,
+// by the square root of the transform's area scale, so a uniformly scaled node
+// keeps its proportions; with scaling off it is in pixels. The stroke state
+// starts out at its defaults for every node and is shared by the macros it
+// calls.
+
+const (
+	lineCapButt = iota
+	lineCapRound
+	lineCapSquare
+	lineCapCount
+)
+
+const (
+	lineJoinMiter = iota
+	lineJoinRound
+	lineJoinBevel
+	lineJoinCount
+)
+
+var nvgLineCaps = [lineCapCount]nanovgo.LineCap{
+	lineCapButt:   nanovgo.Butt,
+	lineCapRound:  nanovgo.Round,
+	lineCapSquare: nanovgo.Square,
+}
+
+var nvgLineJoins = [lineJoinCount]nanovgo.LineCap{
+	lineJoinMiter: nanovgo.Miter,
+	lineJoinRound: nanovgo.Round,
+	lineJoinBevel: nanovgo.Bevel,
+}
+
+type strokeState struct {
+	color      nanovgo.Color
+	width      float64
+	lineCap    uint8
+	lineJoin   uint8
+	miterLimit float64
+	scaling    bool // width scales with the node transform
+}
+
+var defaultStroke = strokeState{
+	color:      nanovgo.Color{A: 1},
+	width:      1,
+	lineCap:    lineCapButt,
+	lineJoin:   lineJoinMiter,
+	miterLimit: 10,
+	scaling:    true,
+}
+
+func (c *Client) setStrokeColor(n *Node) {
+	c.stroke.color = c.popRgba()
+}
+
+func (c *Client) setStrokeWidth(n *Node) {
+	width := c.popFloat64()
+	if !(width >= 0) || math.IsInf(width, 0) {
+		c.error(errorOutOfRange, fmt.Sprint("setStrokeWidth: invalid width ", width))
+	}
+	c.stroke.width = width
+}
+
+func (c *Client) setLineCap(n *Node) {
+	lineCap := c.popUint8()
+	if lineCap >= lineCapCount {
+		c.error(errorOutOfRange, fmt.Sprint("setLineCap: invalid line cap ", lineCap))
+	}
+	c.stroke.lineCap = lineCap
+}
+
+func (c *Client) setLineJoin(n *Node) {
+	lineJoin := c.popUint8()
+	if lineJoin >= lineJoinCount {
+		c.error(errorOutOfRange, fmt.Sprint("setLineJoin: invalid line join ", lineJoin))
+	}
+	c.stroke.lineJoin = lineJoin
+}
+
+func (c *Client) setMiterLimit(n *Node) {
+	limit := c.popFloat64()
+	if !(limit >= 1) || math.IsInf(limit, 0) {
+		c.error(errorOutOfRange, fmt.Sprint("setMiterLimit: invalid limit ", limit))
+	}
+	c.stroke.miterLimit = limit
+}
+
+func (c *Client) setStrokeScaling(n *Node) {
+	scaling := c.popUint8()
+	if scaling > 1 {
+		c.error(errorOutOfRange, fmt.Sprint("setStrokeScaling: invalid flag ", scaling))
+	}
+	c.stroke.scaling = scaling == 1
+}
+
+// strokeWidth returns the width of the node's strokes in pixels.
+func (c *Client) strokeWidth(n *Node) float64 {
+	if !c.stroke.scaling {
+		return c.stroke.width
+	}
+	t := n.localToGlobal
+	return c.stroke.width * math.Sqrt(math.Abs(t.m00*t.m11-t.m01*t.m10))
+}
+
+func (c *Client) strokePath(n *Node) {
+	c.nvgCtx.SetStrokeColor(c.stroke.color)
+	c.nvgCtx.SetStrokeWidth(float32(c.strokeWidth(n)))
+	c.nvgCtx.SetLineCap(nvgLineCaps[c.stroke.lineCap])
+	c.nvgCtx.SetLineJoin(nvgLineJoins[c.stroke.lineJoin])
+	c.nvgCtx.SetMiterLimit(float32(c.stroke.miterLimit))
+	c.nvgCtx.Stroke()
+}
+
+func (s *Server) macroSetStrokeColor(color nanovgo.Color) {
+	s.macroOperation(ropSetStrokeColor)
+	s.macroUseConstColor(color)
+}
+
+func (s *Server) macroSetStrokeWidth(width float64) {
+	s.macroOperation(ropSetStrokeWidth)
+	s.macroUseConstNumber(width)
+}
+
+func (s *Server) macroSetLineCap(lineCap uint8) {
+	s.macroOperation(ropSetLineCap)
+	s.macroUseConstUint8(lineCap)
+}
+
+func (s *Server) macroSetLineJoin(lineJoin uint8) {
+	s.macroOperation(ropSetLineJoin)
+	s.macroUseConstUint8(lineJoin)
+}
+
+func (s *Server) macroSetMiterLimit(limit float64) {
+	s.macroOperation(ropSetMiterLimit)
+	s.macroUseConstNumber(limit)
+}
+
+func (s *Server) macroSetStrokeScaling(scaling bool) {
+	s.macroOperation(ropSetStrokeScaling)
+	s.macroUseConstUint8(boolUint8(scaling))
+}
+
+func (s *Server) macroStroke() {
+	s.macroOperation(ropStroke)
+}
+
+func boolUint8(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
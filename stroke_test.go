@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shibukawa/nanovgo"
+)
+
+func TestMacroStrokeState(t *testing.T) {
+	server, client := newTestSession(t)
+	var node NodeNumber
+	sendFrame(t, server, client, func() {
+		macroNumber := server.macroStart()
+		server.macroBeginPath()
+		server.macroMoveTo(Vec2{0, 0})
+		server.macroLineTo(Vec2{10, 10})
+		server.macroSetStrokeColor(colorBlue)
+		server.macroSetStrokeWidth(1.5)
+		server.macroSetLineCap(lineCapRound)
+		server.macroSetLineJoin(lineJoinBevel)
+		server.macroSetMiterLimit(4)
+		server.macroSetStrokeScaling(false)
+		server.macroStroke()
+		server.macroEnd()
+		node = server.nodeCreate()
+		server.nodeSetContent(node, macroNumber)
+	})
+	var stroked []strokeState
+	client.renderOperations[ropStroke] = func(n *Node) { stroked = append(stroked, client.stroke) }
+	renderTestNode(t, client, node)
+	want := strokeState{
+		color:      colorBlue,
+		width:      1.5,
+		lineCap:    lineCapRound,
+		lineJoin:   lineJoinBevel,
+		miterLimit: 4,
+		scaling:    false,
+	}
+	if len(stroked) != 1 || stroked[0] != want {
+		t.Fatalf("stroked with %+v, want %+v", stroked, want)
+	}
+
+	// the test macro strokes with its own state
+	stroked = nil
+	renderTestNode(t, client, testNode1)
+	want = defaultStroke
+	want.color = nanovgo.RGBA(255, 255, 255, 255)
+	want.width = 4
+	want.lineJoin = lineJoinRound
+	if len(stroked) != 1 || stroked[0] != want {
+		t.Fatalf("test macro stroked with %+v, want %+v", stroked, want)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// recordStream writes the negotiated stream header, the init frame and the
+// given number of update frames of the test scene to a file. The stream loads
+// the macros of library if it isn't nil.
+func recordStream(path string, frames int, library *MacroLibrary) error {
+	server := NewServer()
+	client := NewClient(nil)
+	if library != nil {
+		client.UseLibrary(library)
+		server.UseLibrary(library)
+	}
+	answer, err := client.Handshake(server.Offer())
+	if err != nil {
+		return err
+	}
+	if err := server.Accept(answer); err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	if _, err := w.Write(EncodeStreamHeader(server.header)); err != nil {
+		return err
+	}
+	if err := server.WriteInit(w); err != nil {
+		return err
+	}
+	for i := 0; i < frames; i++ {
+		if err := server.WriteUpdate(w); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// disassembleFile prints a stream file, resolving the macros it loads from
+// library.
+func disassembleFile(path string, library *MacroLibrary) error {
+	stream, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	text, err := DisassembleWithLibrary(stream, library)
+	fmt.Print(text)
+	return err
+}
+
+func assembleFile(path string) error {
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	bytes, err := Assemble(string(text))
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(bytes)
+	return err
+}
+
+// writeTestLibrary writes a macro library holding the macro of the test
+// scene.
+func writeTestLibrary(path string) error {
+	file, err := BuildMacroLibrary(NewServer().numberFormat, func(s *Server) {
+		s.defineTestMacro()
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, file, 0644)
+}
+
+func loadLibraryFile(path string) (*MacroLibrary, error) {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return LoadMacroLibrary(file)
+}
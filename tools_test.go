@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestLibrary(t *testing.T) *MacroLibrary {
+	t.Helper()
+	file, err := BuildMacroLibrary(NewServer().numberFormat, func(s *Server) {
+		s.defineTestMacro()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	library, err := LoadMacroLibrary(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return library
+}
+
+func TestInitBindsLibraryTestMacro(t *testing.T) {
+	library := newTestLibrary(t)
+	server := NewServer()
+	client := NewClient(nil)
+	server.UseLibrary(library)
+	client.UseLibrary(library)
+	answer, err := client.Handshake(server.Offer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Accept(answer); err != nil {
+		t.Fatal(err)
+	}
+	frame, err := server.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Update(frame); err != nil {
+		t.Fatal(err)
+	}
+	libraryNumber, ok := server.LibraryMacro(library.Hashes()[0])
+	if !ok || testMacro != libraryNumber {
+		t.Fatalf("test macro %d, want library macro %d", testMacro, libraryNumber)
+	}
+	if server.macroCount != 1 || len(client.macros) != 1 {
+		t.Fatalf("%d macros on the server and %d on the client, want 1", server.macroCount, len(client.macros))
+	}
+	if client.nodes[testNode1].content != client.macros[testMacro] {
+		t.Fatal("test node doesn't show the library macro")
+	}
+	for _, free := range []func(MacroNumber){server.macroDelete, server.macroRelease} {
+		if err := server.build(func() { free(testMacro) }); err == nil {
+			t.Fatal("a library macro was freed")
+		}
+	}
+	if _, ok := server.macroVariables[testMacro]; !ok {
+		t.Fatal("the library macro isn't bound after failing to free it")
+	}
+}
+
+func TestDisassembleFileWithLibrary(t *testing.T) {
+	library := newTestLibrary(t)
+	dir, err := ioutil.TempDir("", "vector-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stream")
+	if err := recordStream(path, 2, library); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Disassemble(stream); err == nil {
+		t.Fatal("stream loading library macros disassembled without the library")
+	}
+	if err := disassembleFile(path, library); err != nil {
+		t.Fatal(err)
+	}
+}